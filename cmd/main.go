@@ -1,21 +1,28 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"fmt"
 	"github.com/alibaba/alibabacloud-ack-connector/common"
 	"github.com/alibaba/alibabacloud-ack-connector/pkg/logging"
-	"github.com/alibaba/alibabacloud-ack-connector/pkg/utils"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tracing"
 	"github.com/alibaba/alibabacloud-ack-connector/pkg/vars"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 	"github.com/alibaba/alibabacloud-ack-connector/pkg/agent"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/audit"
 	"github.com/alibaba/alibabacloud-ack-connector/pkg/config"
 	conf "github.com/alibaba/alibabacloud-ack-connector/pkg/config"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/policy"
 	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
 )
 
 func main() {
@@ -52,14 +59,40 @@ func main() {
 		logger.SetLevel(log.ErrorLevel)
 	}
 
+	// SIGTERM is sent by the kubelet on rolling updates, sessions in flight are drained before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, logger)
+	if err != nil {
+		logger.Fatalf("failed to set up tracing: %s", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// probes are answered from the start, also while the certificate is bootstrapped
+	adminAddr := net.JoinHostPort(opts.adminBindAddress, strconv.Itoa(opts.adminPort))
+	go func() {
+		if err := base.ListenAndServeAdmin(context.Background(), adminAddr, logger, base.DefaultStatus); err != nil {
+			logger.Fatalf("admin server failed: %s", err)
+		}
+	}()
+
 	var clientConfig *config.ClientConfig
 	clientConfig, err = conf.LoadClientConfigFromEnv()
 	if err != nil {
 		logger.Fatalf("configuration error: %s", err)
 	}
 	if agent.IsNotExist(clientConfig.TLSCrt, clientConfig.TLSKey) {
-		err = agent.PutToSecrets(clientConfig)
+		err = agent.PutToSecrets(ctx, clientConfig)
 		if err != nil {
+			if ctx.Err() != nil {
+				logger.Infof("terminated during certificate bootstrap: %s", err)
+				return
+			}
+			var bootstrapErr *agent.BootstrapError
+			if errors.As(err, &bootstrapErr) {
+				logger.WithField("reason", bootstrapErr.Reason).Errorf("hint: %s", bootstrapErr.Hint())
+			}
 			logger.Fatalf("%v", err)
 		}
 		log.Infof("store client crt and key success, continue")
@@ -69,46 +102,88 @@ func main() {
 		logger.Fatal("no tunnels")
 	}
 
-	tlsconf, err := tlsConfig(clientConfig)
+	certManager, err := agent.NewCertManager(clientConfig, logger)
+	if err != nil {
+		logger.Fatalf("failed to load client certificate: %s", err)
+	}
+
+	tlsconf, err := tlsConfig(clientConfig, certManager)
 	if err != nil {
 		logger.Fatalf("failed to configure tls: %s", err)
 	}
 
+	// requests are not forwarded at all if the configured policy cannot be applied
+	policyEngine, err := loadPolicy(ctx, clientConfig, logger)
+	if err != nil {
+		logger.Fatalf("failed to load request policy: %s", err)
+	}
+
 	client, err := agent.NewClient(&agent.ClientConfig{
-		ServerAddr:      clientConfig.ServerAddr,
-		TLSClientConfig: tlsconf,
-		Logger:          logger,
+		ServerAddr:           clientConfig.ServerAddr,
+		TLSClientConfig:      tlsconf,
+		RootCAs:              certManager.RootCAs,
+		Logger:               logger,
+		Multiplex:            clientConfig.Multiplex,
+		MaxSessionsPerTunnel: clientConfig.MaxSessionsPerTunnel,
+		MaxRequestBodySize:   clientConfig.MaxRequestBodySize,
+		FrameInspection:      clientConfig.FrameInspection,
+		MaxFrameSize:         clientConfig.MaxFrameSize,
+		ShutdownGracePeriod:  clientConfig.ShutdownGracePeriod,
+		Transport:            clientConfig.Transport,
+		WebsocketURL:         clientConfig.WebsocketURL,
+		Auditor:              audit.NewLogger(clientConfig.AuditLevel, clientConfig.AuditLogPath, clientConfig.AuditLogMaxSize, clientConfig.AuditLogMaxBackups),
+		Policy:               policyEngine,
 	})
 	if err != nil {
 		logger.Fatalf("failed to create client: %s", err)
 	}
 
-	if err := client.Start(clientConfig.Tunnel.Addr, clientConfig.Tunnel.Cfg, clientConfig.TunnelsPerAgent); err != nil {
+	go certManager.Run(ctx)
+	if policyEngine != nil {
+		go policyEngine.Run(ctx)
+	}
+	if err := client.Start(ctx, clientConfig.Tunnel.Addr, clientConfig.Tunnel.Cfg, clientConfig.TunnelsPerAgent); err != nil {
 		logger.Fatalf("failed to start tunnels: %s", err)
 	}
 
 }
 
-func tlsConfig(config *config.ClientConfig) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(config.TLSCrt, config.TLSKey)
-	if err != nil {
-		return nil, err
-	}
-
-	var roots *x509.CertPool
-	if config.RootCA != "" && utils.IsExist(config.RootCA) {
-		fmt.Println("[WARN]: rootCA: ", config.RootCA, " is exist: but not used now")
+// loadPolicy loads the request policy from PolicyFile or PolicyConfigMap, nil is returned if neither is set.
+func loadPolicy(ctx context.Context, config *config.ClientConfig, logger *log.Logger) (*policy.Engine, error) {
+	var loader policy.Loader
+	switch {
+	case config.PolicyFile != "":
+		loader = policy.FileLoader(config.PolicyFile)
+	case config.PolicyConfigMap != "":
+		client, err := kubernetes.NewForConfig(config.Tunnel.Cfg)
+		if err != nil {
+			return nil, err
+		}
+		loader = policy.ConfigMapLoader(client, agent.Namespace(), config.PolicyConfigMap, config.PolicyConfigMapKey)
+	default:
+		return nil, nil
 	}
+	return policy.NewEngine(ctx, logger, loader)
+}
 
+func tlsConfig(config *config.ClientConfig, certManager *agent.CertManager) (*tls.Config, error) {
 	host, _, err := net.SplitHostPort(config.ServerAddr)
 	if err != nil {
 		return nil, err
 	}
 
-	return &tls.Config{
-		ServerName:         host,
-		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: roots == nil,
-		RootCAs:            roots,
-	}, nil
+	tlsConfig := &tls.Config{
+		ServerName: host,
+		// the certificate and the ca are renewed by certManager while the agent is running
+		GetClientCertificate: certManager.GetClientCertificate,
+		RootCAs:              certManager.RootCAs(),
+	}
+	if config.CAChecksum != "" {
+		pin, err := agent.ParseCAChecksum(config.CAChecksum)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyConnection = agent.VerifyCAChecksum(pin)
+	}
+	return tlsConfig, nil
 }
@@ -5,15 +5,21 @@ import (
 )
 
 type options struct {
-	logLevel int
+	logLevel         int
+	adminBindAddress string
+	adminPort        int
 }
 
 func parseArgs() (*options, error) {
 	logLevel := flag.Int("log-level", 1, "Level of messages to log, (-1)-3")
+	adminBindAddress := flag.String("admin-bind-address", "0.0.0.0", "Address the admin server serving probes and metrics binds to")
+	adminPort := flag.Int("admin-port", 10254, "Port of the admin server serving probes and metrics")
 	flag.Parse()
 
 	opts := &options{
-		logLevel: *logLevel,
+		logLevel:         *logLevel,
+		adminBindAddress: *adminBindAddress,
+		adminPort:        *adminPort,
 	}
 
 	return opts, nil
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/logging"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/stub"
+	log "github.com/sirupsen/logrus"
+)
+
+// The stub command runs the reference stub server, so agents can be tested end to end without the ACK stub.
+// Start it, point ALI_STUB_REGISTER_ADDR of the agent to its listen address and run kubectl against the kube listener:
+//
+//	kubectl --server http://127.0.0.1:8001 get nodes
+func main() {
+	opts, err := parseArgs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger := logging.NewLogger(opts.logLevel)
+
+	var cert tls.Certificate
+	if opts.tlsCert != "" {
+		cert, err = tls.LoadX509KeyPair(opts.tlsCert, opts.tlsKey)
+		if err != nil {
+			logger.Fatalf("failed to load certificate: %s", err)
+		}
+	} else {
+		var certPEM []byte
+		cert, certPEM, err = stub.SelfSignedCertificate(opts.hostnames)
+		if err != nil {
+			logger.Fatalf("failed to generate certificate: %s", err)
+		}
+		if opts.caOut != "" {
+			if err = ioutil.WriteFile(opts.caOut, certPEM, 0644); err != nil {
+				logger.Fatalf("failed to write ca: %s", err)
+			}
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	server := stub.NewServer(ctx, logger, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	server.Multiplex = opts.multiplex
+	go func() {
+		if err := server.ListenAndServeKube(opts.kubeListen); err != nil {
+			logger.Fatalf("kube server failed: %s", err)
+		}
+	}()
+	if opts.websocket != "" {
+		go func() {
+			if err := server.ListenAndServeWebsocket(opts.websocket); err != nil {
+				logger.Fatalf("websocket server failed: %s", err)
+			}
+		}()
+	}
+	if opts.proxy != "" {
+		go func() {
+			if err := server.ListenAndServeProxy(opts.proxy, opts.proxyAuth); err != nil {
+				logger.Fatalf("connect proxy failed: %s", err)
+			}
+		}()
+	}
+	if err := server.ListenAndServe(opts.listen); err != nil {
+		logger.Fatalf("stub server failed: %s", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+type options struct {
+	logLevel   int
+	listen     string
+	kubeListen string
+	tlsCert    string
+	tlsKey     string
+	hostnames  []string
+	caOut      string
+	multiplex  bool
+	proxy      string
+	proxyAuth  string
+	websocket  string
+}
+
+func parseArgs() (*options, error) {
+	logLevel := flag.Int("log-level", 1, "Level of messages to log, (-1)-3")
+	listen := flag.String("listen", ":5533", "Address agents connect to")
+	kubeListen := flag.String("kube-listen", "127.0.0.1:8001", "Address of the kube-style HTTP listener for kubectl")
+	tlsCert := flag.String("tls-cert", "", "Server certificate file, a self-signed one is generated if empty")
+	tlsKey := flag.String("tls-key", "", "Server private key file")
+	hostnames := flag.String("hostnames", "localhost,127.0.0.1", "Comma separated host names and IPs of the self-signed certificate")
+	caOut := flag.String("ca-out", "", "File to write the self-signed certificate to, usable as the agent root CA")
+	multiplex := flag.Bool("multiplex", true, "Accept tunnels which multiplex sessions as streams")
+	proxy := flag.String("proxy-listen", "", "Address of a HTTP CONNECT proxy for testing the agent behind an egress proxy, disabled if empty")
+	proxyAuth := flag.String("proxy-auth", "", "Credentials required by the CONNECT proxy as user:password")
+	websocketListen := flag.String("websocket-listen", "", "Address agents using the websocket transport connect to, disabled if empty")
+	flag.Parse()
+
+	opts := &options{
+		logLevel:   *logLevel,
+		listen:     *listen,
+		kubeListen: *kubeListen,
+		tlsCert:    *tlsCert,
+		tlsKey:     *tlsKey,
+		hostnames:  strings.Split(*hostnames, ","),
+		caOut:      *caOut,
+		multiplex:  *multiplex,
+		proxy:      *proxy,
+		proxyAuth:  *proxyAuth,
+		websocket:  *websocketListen,
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,272 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/clockskew"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/config"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/logging"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxResponseSize bounds the response of the certificate endpoint.
+	maxResponseSize = 1 << 20
+	// bootstrapSource names the certificate endpoint in clock skew reports.
+	bootstrapSource = "the certificate endpoint"
+)
+
+// BootstrapReason tells why bootstrapping the certificate failed.
+type BootstrapReason string
+
+const (
+	BootstrapInvalidToken      BootstrapReason = "InvalidToken"
+	BootstrapExpiredToken      BootstrapReason = "ExpiredToken"
+	BootstrapClockSkew         BootstrapReason = "ClockSkew"
+	BootstrapNetworkError      BootstrapReason = "NetworkError"
+	BootstrapServerError       BootstrapReason = "ServerError"
+	BootstrapMalformedResponse BootstrapReason = "MalformedResponse"
+	BootstrapInvalidConfig     BootstrapReason = "InvalidConfig"
+)
+
+// BootstrapError is returned by BootstrapClient, network and server errors are retried before they are returned.
+type BootstrapError struct {
+	Reason BootstrapReason
+	// StatusCode is the status of the response, 0 if there is none.
+	StatusCode int
+	Err        error
+}
+
+func (e *BootstrapError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("bootstrap certificate: %s (status %d): %s", e.Reason, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("bootstrap certificate: %s: %s", e.Reason, e.Err)
+}
+
+func (e *BootstrapError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the request may succeed when retried.
+func (e *BootstrapError) Temporary() bool {
+	return e.Reason == BootstrapNetworkError || e.Reason == BootstrapServerError
+}
+
+// Hint tells the cluster admin how to fix the error.
+func (e *BootstrapError) Hint() string {
+	switch e.Reason {
+	case BootstrapInvalidToken:
+		return "the bootstrap token was rejected, re-import the cluster in the ACK console to get a new ack-credentials secret"
+	case BootstrapExpiredToken:
+		return "the bootstrap token has expired, re-import the cluster in the ACK console to get a new ack-credentials secret"
+	case BootstrapClockSkew:
+		return "the clock of the node is off, check that NTP is running on the node"
+	case BootstrapNetworkError:
+		return "the certificate endpoint is unreachable, check DNS, firewalls and HTTPS_PROXY for the url in the ack-credentials secret"
+	case BootstrapServerError:
+		return "the certificate endpoint failed, retry later or contact ACK support"
+	case BootstrapMalformedResponse:
+		return "the certificate endpoint returned an unexpected response, check the url in the ack-credentials secret"
+	case BootstrapInvalidConfig:
+		return "check the url and token in the ack-credentials secret"
+	}
+	return ""
+}
+
+// BootstrapClient requests the certificate of the agent from the ACK certificate endpoint with the bootstrap token.
+type BootstrapClient struct {
+	ClusterID string
+	URLPath   string
+	TokenPath string
+	// TokenMode selects how the bootstrap token is sent, config.TokenModeHeader or config.TokenModeQuery.
+	TokenMode string
+	Client    *http.Client
+	// Backoff configures the retries of temporary errors, they are retried until Backoff.MaxTime.
+	Backoff config.BackoffConfig
+}
+
+func NewBootstrapClient(cfg *config.ClientConfig) *BootstrapClient {
+	backoffConfig := cfg.Backoff
+	backoffConfig.MaxTime = cfg.BootstrapRetryTimeout
+	return &BootstrapClient{
+		ClusterID: cfg.ClusterID,
+		URLPath:   cfg.ConvertUrl,
+		TokenPath: cfg.Token,
+		TokenMode: cfg.TokenMode,
+		Client:    &http.Client{Timeout: cfg.BootstrapTimeout},
+		Backoff:   backoffConfig,
+	}
+}
+
+// GetCert downloads the certificate and the private key of the agent.
+func (c *BootstrapClient) GetCert(ctx context.Context) (ca, crt, key []byte, err error) {
+	tokenresp, err := c.request(ctx, http.MethodGet, nil)
+	if err != nil {
+		return
+	}
+	return decodeCert(tokenresp)
+}
+
+// RequestCert submits the PEM encoded CSR to the certificate url with the bootstrap token. Only the signed
+// certificate and the CA are returned, the private key never leaves the agent.
+func (c *BootstrapClient) RequestCert(ctx context.Context, csr []byte) (ca, crt []byte, err error) {
+	body, err := json.Marshal(&CSR{CSR: base64.StdEncoding.EncodeToString(csr)})
+	if err != nil {
+		return nil, nil, err
+	}
+	tokenresp, err := c.request(ctx, http.MethodPost, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tokenresp.KEY != "" {
+		logrus.Warn("certificate response carries a private key, which is ignored in csr mode")
+		tokenresp.KEY = ""
+	}
+	ca, crt, _, err = decodeCert(tokenresp)
+	return ca, crt, err
+}
+
+// request sends the request, retrying temporary errors with exponential backoff.
+func (c *BootstrapClient) request(ctx context.Context, method string, body []byte) (*CERT, error) {
+	backoffConfig := backoff.NewExponentialBackOff()
+	backoffConfig.InitialInterval = c.Backoff.Interval
+	backoffConfig.Multiplier = c.Backoff.Multiplier
+	backoffConfig.MaxInterval = c.Backoff.MaxInterval
+	backoffConfig.MaxElapsedTime = c.Backoff.MaxTime
+	backoffConfig.Reset()
+
+	var tokenresp *CERT
+	err := backoff.RetryNotify(func() error {
+		var err error
+		tokenresp, err = c.do(ctx, method, body)
+		var bootstrapErr *BootstrapError
+		if errors.As(err, &bootstrapErr) && !bootstrapErr.Temporary() {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, backoff.WithContext(backoffConfig, ctx), func(err error, wait time.Duration) {
+		logrus.Warnf("[%s] %s, retry after %s", c.ClusterID, err, wait.Round(time.Millisecond))
+	})
+	return tokenresp, err
+}
+
+// do sends the bootstrap token in the Authorization header, or as the token query parameter in
+// config.TokenModeQuery for endpoints predating the header.
+func (c *BootstrapClient) do(ctx context.Context, method string, body []byte) (*CERT, error) {
+	rawurl, err := ioutil.ReadFile(c.URLPath)
+	if err != nil {
+		return nil, &BootstrapError{Reason: BootstrapInvalidConfig, Err: errors.New("url not exist in Secret")}
+	}
+
+	token, err := ioutil.ReadFile(c.TokenPath)
+	if err != nil {
+		return nil, &BootstrapError{Reason: BootstrapInvalidConfig, Err: fmt.Errorf("read %s in Secret err %v", c.TokenPath, err)}
+	}
+	token = bytes.TrimSpace(token)
+	logging.DefaultRedactor.AddSecret(string(token))
+	//http://cs-anony.aliyuncs.com/clusters/{{.ClusterID}}/agent/certs?Version=2015-12-15
+
+	url := strings.Replace(strings.TrimSpace(string(rawurl)), "{{.ClusterID}}", c.ClusterID, 1)
+	requestURL := url
+	if c.TokenMode == config.TokenModeQuery {
+		requestURL += "&token=" + string(token)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, &BootstrapError{Reason: BootstrapInvalidConfig, Err: fmt.Errorf("get certificate form request err: %v", err)}
+	}
+	if c.TokenMode != config.TokenModeQuery {
+		req.Header.Set("Authorization", "Bearer "+string(token))
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Date", time.Now().Format(time.RFC1123Z))
+	logrus.Printf("[%s] request for token by url %s  HEADER Date %s", c.ClusterID, url, req.Header.Get("Date"))
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &BootstrapError{Reason: BootstrapNetworkError, Err: err}
+	}
+	defer resp.Body.Close()
+	clockskew.Default.ObserveResponse(bootstrapSource, resp)
+	datas, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, &BootstrapError{Reason: BootstrapNetworkError, StatusCode: resp.StatusCode, Err: fmt.Errorf("get certificate read body err: %v", err)}
+	}
+
+	if resp.StatusCode != 200 {
+		if skewErr := clockskew.Default.Check(); skewErr != nil && resp.StatusCode < 500 {
+			return nil, &BootstrapError{Reason: BootstrapClockSkew, StatusCode: resp.StatusCode, Err: skewErr}
+		}
+		return nil, &BootstrapError{
+			Reason:     classifyStatus(resp, datas),
+			StatusCode: resp.StatusCode,
+			Err:        fmt.Errorf("get certificate info err, body is %s", strings.TrimSpace(string(datas))),
+		}
+	}
+	var tokenresp CERT
+	err = json.Unmarshal(datas, &tokenresp)
+	if err != nil {
+		return nil, &BootstrapError{Reason: BootstrapMalformedResponse, StatusCode: resp.StatusCode, Err: fmt.Errorf("get certificate unmrashal result err: %v", err)}
+	}
+	if tokenresp.CRT == "" {
+		return nil, &BootstrapError{Reason: BootstrapMalformedResponse, StatusCode: resp.StatusCode, Err: errors.New("no certificate in response")}
+	}
+	return &tokenresp, nil
+}
+
+// classifyStatus tells the reason of a failed response.
+func classifyStatus(resp *http.Response, body []byte) BootstrapReason {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return BootstrapServerError
+	case resp.StatusCode >= 400:
+		if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+			return BootstrapInvalidConfig
+		}
+		if strings.Contains(strings.ToLower(string(body)), "expire") {
+			return BootstrapExpiredToken
+		}
+		return BootstrapInvalidToken
+	}
+	return BootstrapMalformedResponse
+}
+
+func decodeCert(tokenresp *CERT) (ca, crt, key []byte, err error) {
+	ca, err = base64.StdEncoding.DecodeString(tokenresp.CA)
+	if err != nil {
+		err = &BootstrapError{Reason: BootstrapMalformedResponse, Err: fmt.Errorf("base64 decode ca err: %v", err)}
+		return
+	}
+	crt, err = base64.StdEncoding.DecodeString(tokenresp.CRT)
+	if err != nil {
+		err = &BootstrapError{Reason: BootstrapMalformedResponse, Err: fmt.Errorf("base64 decode crt err: %v", err)}
+		return
+	}
+	if tokenresp.KEY != "" {
+		key, err = base64.StdEncoding.DecodeString(tokenresp.KEY)
+		if err != nil {
+			err = &BootstrapError{Reason: BootstrapMalformedResponse, Err: fmt.Errorf("base64 decode key err: %v", err)}
+			return
+		}
+	}
+
+	return ca, crt, key, nil
+}
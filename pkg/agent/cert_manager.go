@@ -0,0 +1,201 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/clockskew"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// CertRenewRetryInterval is how long to wait before retrying a failed renewal.
+	CertRenewRetryInterval = time.Minute
+	// CertRenewFraction is the part of the certificate lifetime after which it is renewed, if no RenewBefore is set.
+	CertRenewFraction = 2.0 / 3
+)
+
+// CertManager holds the client certificate of the agent and the CA the stub is verified against, and renews them
+// ahead of the expiry of the certificate by running the bootstrap flow again. New connections to the stub pick up
+// the renewed certificate through GetClientCertificate and the renewed CA through RootCAs, connections already
+// established keep working.
+type CertManager struct {
+	config *config.ClientConfig
+	logger *logrus.Logger
+	// RenewBefore renews the certificate this long before it expires, CertRenewFraction of its lifetime is used
+	// if it is 0.
+	RenewBefore time.Duration
+	// cert is the current *tls.Certificate with its Leaf parsed.
+	cert atomic.Value
+	// roots is the current rootCAs.
+	roots atomic.Value
+
+	// bootstrap and store get and persist renewed credentials, retryInterval is CertRenewRetryInterval. They are
+	// only replaced by tests.
+	bootstrap     func(ctx context.Context, config *config.ClientConfig) (ca, crt, key []byte, err error)
+	store         func(ctx context.Context, ca, crt, key []byte) error
+	retryInterval time.Duration
+}
+
+// rootCAs holds the CA certificates of the stub, pool is nil for the system roots.
+type rootCAs struct {
+	pool *x509.CertPool
+}
+
+// NewCertManager loads the certificate from TLSCrtData and TLSKeyData of config if bootstrapped, or from the TLSCrt
+// and TLSKey files, and the CA of the stub from RootCAData or the RootCA file.
+func NewCertManager(config *config.ClientConfig, logger *logrus.Logger) (*CertManager, error) {
+	var cert tls.Certificate
+	var err error
+	if len(config.TLSCrtData) > 0 {
+		cert, err = tls.X509KeyPair(config.TLSCrtData, config.TLSKeyData)
+	} else {
+		cert, err = tls.LoadX509KeyPair(config.TLSCrt, config.TLSKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the stub is verified against the CA delivered with the agent certificate, or the system roots without it
+	var roots *x509.CertPool
+	if len(config.RootCAData) > 0 {
+		roots, err = ParseRootCAs(config.RootCAData)
+	} else {
+		roots, err = LoadRootCAs(config.RootCA)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load ca: %s", err)
+	}
+	m := &CertManager{
+		config:        config,
+		logger:        logger,
+		RenewBefore:   config.CertRenewBefore,
+		bootstrap:     Bootstrap,
+		retryInterval: CertRenewRetryInterval,
+	}
+	m.store = func(ctx context.Context, ca, crt, key []byte) error {
+		return UpdateSecrets(ctx, m.config, ca, crt, key, true)
+	}
+	if err = m.setCertificate(&cert); err != nil {
+		return nil, err
+	}
+	m.roots.Store(rootCAs{pool: roots})
+	return m, nil
+}
+
+// GetClientCertificate is meant to be used as tls.Config.GetClientCertificate.
+func (m *CertManager) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return m.Certificate(), nil
+}
+
+// Certificate returns the current client certificate.
+func (m *CertManager) Certificate() *tls.Certificate {
+	return m.cert.Load().(*tls.Certificate)
+}
+
+// RootCAs returns the current CA certificates of the stub, nil for the system roots. It is meant to be used as
+// tls.Config.RootCAs of every new connection.
+func (m *CertManager) RootCAs() *x509.CertPool {
+	return m.roots.Load().(rootCAs).pool
+}
+
+// Run renews the certificate whenever it is due until ctx is done. A failed renewal is retried every
+// CertRenewRetryInterval.
+func (m *CertManager) Run(ctx context.Context) {
+	renewed := false
+	for {
+		leaf := m.Certificate().Leaf
+		wait := time.Until(m.renewAt(leaf))
+		if renewed && wait < m.retryInterval {
+			// the renewed certificate is due already, don't hammer the server
+			wait = m.retryInterval
+		}
+		m.logger.Infof("client certificate expires at %s, renew in %s", leaf.NotAfter.Format(time.RFC3339), wait.Round(time.Second))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		for {
+			err := m.renew(ctx)
+			if err == nil {
+				m.logger.Info("client certificate renewed")
+				renewed = true
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			m.logger.Errorf("renew client certificate failed: %s, retry after %s", err, m.retryInterval)
+			var bootstrapErr *BootstrapError
+			if errors.As(err, &bootstrapErr) {
+				m.logger.WithField("reason", bootstrapErr.Reason).Errorf("hint: %s", bootstrapErr.Hint())
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(m.retryInterval):
+			}
+		}
+	}
+}
+
+// renewAt returns when the certificate is due for renewal.
+func (m *CertManager) renewAt(leaf *x509.Certificate) time.Time {
+	if m.RenewBefore > 0 {
+		return leaf.NotAfter.Add(-m.RenewBefore)
+	}
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	return leaf.NotBefore.Add(time.Duration(float64(lifetime) * CertRenewFraction))
+}
+
+// renew runs the bootstrap flow to get a new certificate, and the CA of the stub if one is returned with it. They are
+// applied and stored in the ack-credentials secrets, so they survive restarts.
+func (m *CertManager) renew(ctx context.Context) error {
+	ca, crt, key, err := m.bootstrap(ctx, m.config)
+	if err != nil {
+		return fmt.Errorf("get tls config error: %w", err)
+	}
+	if len(key) == 0 {
+		return errors.New("no key returned with the certificate")
+	}
+	cert, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		return err
+	}
+	roots, err := ParseRootCAs(ca)
+	if err != nil {
+		return fmt.Errorf("parse renewed ca: %s", err)
+	}
+	if err = m.setCertificate(&cert); err != nil {
+		return err
+	}
+	if roots != nil {
+		m.roots.Store(rootCAs{pool: roots})
+		m.logger.Info("ca of the stub renewed")
+	}
+	if err = m.store(ctx, ca, crt, key); err != nil {
+		// the certificate is still usable until the next restart
+		m.logger.Warnf("store renewed certificate failed: %s", err)
+	}
+	return nil
+}
+
+func (m *CertManager) setCertificate(cert *tls.Certificate) error {
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+	}
+	// a certificate which is not valid yet is rejected by the stub
+	clockskew.Default.ObserveCertificate("the client certificate", cert.Leaf)
+	m.cert.Store(cert)
+	return nil
+}
@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestCert returns a self-signed PEM certificate valid from notBefore to notAfter and its PEM key.
+func newTestCert(t *testing.T, name string, notBefore, notAfter time.Time) (crt, key []byte) {
+	t.Helper()
+	signer, key, err := GenerateKey(config.KeyTypeECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), key
+}
+
+func newTestCertManager(t *testing.T, crt, key []byte) *CertManager {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	m, err := NewCertManager(&config.ClientConfig{TLSCrtData: crt, TLSKeyData: key, RootCAData: crt}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.store = func(context.Context, []byte, []byte, []byte) error { return nil }
+	return m
+}
+
+func TestRenewAt(t *testing.T) {
+	notBefore := time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := notBefore.Add(90 * 24 * time.Hour)
+	for _, test := range []struct {
+		name        string
+		renewBefore time.Duration
+		want        time.Time
+	}{
+		{"fraction of the lifetime", 0, notBefore.Add(60 * 24 * time.Hour)},
+		{"renew before", 7 * 24 * time.Hour, notAfter.Add(-7 * 24 * time.Hour)},
+	} {
+		m := &CertManager{RenewBefore: test.renewBefore}
+		leaf := &x509.Certificate{NotBefore: notBefore, NotAfter: notAfter}
+		if got := m.renewAt(leaf); !got.Equal(test.want) {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRenewAppliesCA(t *testing.T) {
+	now := time.Now()
+	crt, key := newTestCert(t, "agent", now.Add(-time.Hour), now.Add(time.Hour))
+	renewedCrt, renewedKey := newTestCert(t, "agent", now, now.Add(2*time.Hour))
+	rotatedCA, _ := newTestCert(t, "rotated ca", now, now.Add(24*time.Hour))
+
+	for _, test := range []struct {
+		name string
+		ca   []byte
+		// wantCA is the ca the roots hold after the renewal
+		wantCA []byte
+	}{
+		{"ca rotated", rotatedCA, rotatedCA},
+		{"no ca returned", nil, crt},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestCertManager(t, crt, key)
+			var stored []byte
+			m.store = func(_ context.Context, ca, _, _ []byte) error {
+				stored = ca
+				return nil
+			}
+			m.bootstrap = func(context.Context, *config.ClientConfig) ([]byte, []byte, []byte, error) {
+				return test.ca, renewedCrt, renewedKey, nil
+			}
+			if err := m.renew(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !m.Certificate().Leaf.NotAfter.Equal(now.Add(2 * time.Hour).Truncate(time.Second)) {
+				t.Errorf("got certificate expiring at %s, want the renewed one", m.Certificate().Leaf.NotAfter)
+			}
+			want, _ := ParseRootCAs(test.wantCA)
+			if !m.RootCAs().Equal(want) {
+				t.Error("roots do not hold the expected ca")
+			}
+			if string(stored) != string(test.ca) {
+				t.Error("renewed ca not stored")
+			}
+		})
+	}
+}
+
+func TestRenewInvalidCA(t *testing.T) {
+	now := time.Now()
+	crt, key := newTestCert(t, "agent", now.Add(-time.Hour), now.Add(time.Hour))
+	renewedCrt, renewedKey := newTestCert(t, "agent", now, now.Add(2*time.Hour))
+	m := newTestCertManager(t, crt, key)
+	m.bootstrap = func(context.Context, *config.ClientConfig) ([]byte, []byte, []byte, error) {
+		return []byte("not a certificate"), renewedCrt, renewedKey, nil
+	}
+	if err := m.renew(context.Background()); err == nil {
+		t.Fatal("renewal with an invalid ca succeeded")
+	}
+	if !m.Certificate().Leaf.NotAfter.Equal(now.Add(time.Hour).Truncate(time.Second)) {
+		t.Error("certificate replaced by a failed renewal")
+	}
+}
+
+// Run renews a certificate which is due right away, retries a failed renewal after the retry interval, and waits at
+// least the retry interval before renewing a renewed certificate which is due already.
+func TestRunSchedulesRenewal(t *testing.T) {
+	now := time.Now()
+	// two thirds of the lifetime are over, so it is due
+	crt, key := newTestCert(t, "agent", now.Add(-2*time.Hour), now.Add(time.Hour))
+	m := newTestCertManager(t, crt, key)
+	m.retryInterval = 100 * time.Millisecond
+	// the renewed certificate is due as well
+	dueCrt, dueKey := newTestCert(t, "agent", now.Add(-2*time.Hour), now.Add(time.Hour))
+
+	var lock sync.Mutex
+	var calls []time.Time
+	m.bootstrap = func(context.Context, *config.ClientConfig) ([]byte, []byte, []byte, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls = append(calls, time.Now())
+		if len(calls) == 1 {
+			return nil, nil, nil, errors.New("bootstrap server unavailable")
+		}
+		return nil, dueCrt, dueKey, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lock.Lock()
+		n := len(calls)
+		lock.Unlock()
+		if n >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d renewals, want 3", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return when its context was done")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if calls[0].Sub(now) > m.retryInterval {
+		t.Errorf("due certificate renewed after %s", calls[0].Sub(now))
+	}
+	for i := 1; i < 3; i++ {
+		if gap := calls[i].Sub(calls[i-1]); gap < m.retryInterval {
+			t.Errorf("renewal %d after %s, want at least %s", i+1, gap, m.retryInterval)
+		}
+	}
+}
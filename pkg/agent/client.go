@@ -3,11 +3,14 @@ package agent
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net/url"
 	"time"
 
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/audit"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/policy"
 	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel"
 	"k8s.io/client-go/rest"
 
@@ -17,7 +20,24 @@ import (
 type ClientConfig struct {
 	ServerAddr      string
 	TLSClientConfig *tls.Config
-	Logger          *log.Logger
+	// RootCAs returns the current CA of the stub, it replaces TLSClientConfig.RootCAs on each dial if set.
+	RootCAs   func() *x509.CertPool
+	Logger    *log.Logger
+	Multiplex bool
+	// MaxSessionsPerTunnel bounds the sessions in flight on each tunnel, further requests are answered with 503.
+	MaxSessionsPerTunnel int
+	FrameInspection      bool
+	MaxFrameSize         int
+	// ShutdownGracePeriod is how long sessions in flight may run once Start is asked to stop.
+	ShutdownGracePeriod time.Duration
+	Transport           string
+	WebsocketURL        string
+	// MaxRequestBodySize bounds the request bodies buffered by the agent, larger requests are answered with 413.
+	MaxRequestBodySize int64
+	// Auditor records the proxied requests, nothing is recorded if it is nil.
+	Auditor *audit.Logger
+	// Policy decides which requests are forwarded to the api server, all are if it is nil.
+	Policy *policy.Engine
 }
 
 type Client struct {
@@ -47,7 +67,8 @@ func NewClient(config *ClientConfig) (*Client, error) {
 	return c, nil
 }
 
-func (c *Client) Start(targetURLStr string, cfg *rest.Config, tunnelsPerAgent int) error {
+// Start runs the tunnels until ctx is done, and drains them before it returns nil.
+func (c *Client) Start(ctx context.Context, targetURLStr string, cfg *rest.Config, tunnelsPerAgent int) error {
 
 	c.logger.Info("agent started")
 
@@ -56,10 +77,31 @@ func (c *Client) Start(targetURLStr string, cfg *rest.Config, tunnelsPerAgent in
 		if err != nil {
 			return err
 		}
-		err = tcp_tunnel.RunAgent(context.Background(), c.logger, c.config.ServerAddr, targetURL, cfg, c.config.TLSClientConfig, tunnelsPerAgent)
+		err = tcp_tunnel.RunAgent(ctx, c.logger, &tcp_tunnel.AgentConfig{
+			ServerAddr:           c.config.ServerAddr,
+			TargetURL:            targetURL,
+			RestConfig:           cfg,
+			TLSConfig:            c.config.TLSClientConfig,
+			RootCAs:              c.config.RootCAs,
+			TunnelsPerAgent:      tunnelsPerAgent,
+			Multiplex:            c.config.Multiplex,
+			MaxSessionsPerTunnel: c.config.MaxSessionsPerTunnel,
+			MaxRequestBodySize:   c.config.MaxRequestBodySize,
+			FrameInspection:      c.config.FrameInspection,
+			MaxFrameSize:         c.config.MaxFrameSize,
+			ShutdownGracePeriod:  c.config.ShutdownGracePeriod,
+			Transport:            c.config.Transport,
+			WebsocketURL:         c.config.WebsocketURL,
+			Auditor:              c.config.Auditor,
+			Policy:               c.config.Policy,
+		})
 		if err != nil {
 			c.logger.Error("agent client failed: ", err)
 		}
+		if ctx.Err() != nil {
+			c.logger.Info("agent stopped")
+			return nil
+		}
 
 		c.logger.Info("connection disconnected")
 
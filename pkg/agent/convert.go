@@ -2,24 +2,17 @@ package agent
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/alibaba/alibabacloud-ack-connector/pkg/vars"
 	"io/ioutil"
-	"net/http"
 	"os"
-	"strings"
-	"time"
+	"path/filepath"
 
 	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
 
-	v12 "k8s.io/api/core/v1"
-
 	"github.com/alibaba/alibabacloud-ack-connector/pkg/config"
 	"github.com/sirupsen/logrus"
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -29,6 +22,11 @@ type CERT struct {
 	KEY string `json:"key"`
 }
 
+// CSR is the request body of the csr bootstrap mode, it carries the base64 encoded PEM of the CSR.
+type CSR struct {
+	CSR string `json:"csr"`
+}
+
 func IsNotExist(crt, key string) bool {
 	_, err := os.Stat(crt)
 	if os.IsNotExist(err) {
@@ -41,155 +39,85 @@ func IsNotExist(crt, key string) bool {
 	return false
 }
 
-func GetCert(clusterid, urlpath, tokenpath string) (ca, crt, key []byte, err error) {
-	rawurl, err := ioutil.ReadFile(urlpath)
-	if err != nil {
-		err = errors.New("url not exist in Secret")
-		return
+// Bootstrap obtains the credentials of the agent in the configured bootstrap mode. In csr mode the private key is
+// generated locally and only a CSR is sent, in download mode the key is downloaded along with the certificate.
+// Retries stop once ctx is done.
+func Bootstrap(ctx context.Context, cfg *config.ClientConfig) (ca, crt, key []byte, err error) {
+	client := NewBootstrapClient(cfg)
+	if cfg.CertBootstrapMode != config.CertBootstrapCSR {
+		return client.GetCert(ctx)
 	}
-
-	token, err := ioutil.ReadFile(tokenpath)
+	signer, key, err := GenerateKey(cfg.CertKeyType)
 	if err != nil {
-		err = errors.New("")
-		return []byte{}, []byte{}, []byte{}, fmt.Errorf("read %s in Secret err %v", tokenpath, err)
+		return nil, nil, nil, fmt.Errorf("generate key: %s", err)
 	}
-	//http://cs-anony.aliyuncs.com/clusters/{{.ClusterID}}/agent/certs?Version=2015-12-15
-
-	url := strings.Replace(string(rawurl), "{{.ClusterID}}", clusterid, 1) + "&token=" + string(token)
-
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	csr, err := NewCSR(cfg.ClusterID, signer)
 	if err != nil {
-		err = fmt.Errorf("get certificate form request err: %v", err)
-		return
+		return nil, nil, nil, fmt.Errorf("create csr: %s", err)
 	}
-	req.Header.Set("Date", time.Now().Format(time.RFC1123Z))
-	logrus.Printf("[%s] request for token by url %s  HEADER Date %s", clusterid, url, req.Header.Get("Date"))
-	resp, err := http.DefaultClient.Do(req)
+	ca, crt, err = client.RequestCert(ctx, csr)
+	return ca, crt, key, err
+}
+
+// PutToSecrets bootstraps the credentials of the agent and stores them in the ack-credentials secrets. The root
+// filesystem may be read-only, so they are kept in memory in config, and written to config.CredentialsDir if set.
+func PutToSecrets(ctx context.Context, config *config.ClientConfig) error {
+	ca, crt, key, err := Bootstrap(ctx, config)
 	if err != nil {
-		return
+		return fmt.Errorf("get tls config error: %w", err)
 	}
-	defer resp.Body.Close()
-	datas, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-
-		err = fmt.Errorf("get certificate read body err: %v", err)
-		return
+	if err = UpdateSecrets(ctx, config, ca, crt, key, false); err != nil {
+		if !errors.Is(err, ErrCredentialsSecretNotFound) {
+			return err
+		}
+		logrus.Warnf("%s, the credentials are bootstrapped again on restart", err)
 	}
 
-	if resp.StatusCode != 200 {
-		err = fmt.Errorf("get certificate info err %d, body is  %s", resp.StatusCode, string(datas))
-		return
+	config.TLSCrtData = crt
+	config.TLSKeyData = key
+	if len(ca) > 0 {
+		config.RootCAData = ca
 	}
-	var tokenresp CERT
-	err = json.Unmarshal(datas, &tokenresp)
-	if err != nil {
-		fmt.Println(string(datas))
-		err = fmt.Errorf("get certificate unmrashal result err: %v", err)
-		return
+	if config.CredentialsDir == "" {
+		return nil
 	}
-
-	ca, err = base64.StdEncoding.DecodeString(tokenresp.CA)
-	if err != nil {
-		err = fmt.Errorf("base64 decode ca err: %v", err)
-		return
+	config.TLSCrt = filepath.Join(config.CredentialsDir, "tls.crt")
+	config.TLSKey = filepath.Join(config.CredentialsDir, "tls.key")
+	if err = ioutil.WriteFile(config.TLSCrt, crt, 0600); err != nil {
+		return fmt.Errorf("rewrite tls crt file failed: %s", err)
 	}
-	crt, err = base64.StdEncoding.DecodeString(tokenresp.CRT)
-	if err != nil {
-		err = fmt.Errorf("base64 decode crt err: %v", err)
-		return
+	if err = ioutil.WriteFile(config.TLSKey, key, 0600); err != nil {
+		return fmt.Errorf("rewrite tls key file failed: %s", err)
 	}
-	if tokenresp.KEY != "" {
-		key, err = base64.StdEncoding.DecodeString(tokenresp.KEY)
-		if err != nil {
-			err = fmt.Errorf("base64 decode key err: %v", err)
-			return
+	if len(ca) > 0 {
+		config.RootCA = filepath.Join(config.CredentialsDir, "ca.crt")
+		if err = ioutil.WriteFile(config.RootCA, ca, 0644); err != nil {
+			return fmt.Errorf("rewrite ca file failed: %s", err)
 		}
 	}
-
-	return ca, crt, key, err
+	return nil
 }
 
-func PutToSecrets(config *config.ClientConfig) error {
-	ca, crt, key, err := GetCert(config.ClusterID, config.ConvertUrl, config.Token)
+// Namespace returns the namespace of the agent pod, base.DefaultAgentNamespace outside a pod.
+func Namespace() string {
+	bytes, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
 	if err != nil {
-		return fmt.Errorf("get tls config error: %s", err)
+		return base.DefaultAgentNamespace
 	}
+	return string(bytes)
+}
+
+// UpdateSecrets stores the credentials in the credentials secrets, the one named SECRET_NAME or those matching
+// CREDENTIALS_SECRET_SELECTOR. Secrets which already hold a cert and key are only updated if overwrite is set, e.g.
+// when the certificate is renewed.
+func UpdateSecrets(ctx context.Context, config *config.ClientConfig, ca, crt, key []byte, overwrite bool) error {
 	client, err := kubernetes.NewForConfig(config.Tunnel.Cfg)
 	if err != nil {
 		return fmt.Errorf("put tls config to apiserver error: %s", err)
 	}
-	var namespace string
-	bytes, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
-	if err != nil {
-		namespace = base.DefaultAgentNamespace
-	} else {
-		namespace = string(bytes)
-	}
-
-	secretName := os.Getenv(vars.SECRET_NAME)
-	if secretName == "" {
-		// handle all the secrets which begin with ack-credentials
-		secrets, err := client.CoreV1().Secrets(namespace).List(context.TODO(), v1.ListOptions{
-			TypeMeta: v1.TypeMeta{},
-		})
-		if err != nil {
-			return err
-		}
-		for _, v := range secrets.Items {
-			if v.Type == v12.SecretTypeOpaque && strings.HasPrefix(v.Name, "ack-credentials") {
-				if len(string(v.Data[vars.TlsCrt])) > 0 && len(string(v.Data[vars.TlsKey])) > 0 {
-					// already update, so no need
-					continue
-				}
-				v.Data[vars.TlsCrt] = []byte(crt)
-				v.Data[vars.TlsKey] = []byte(key)
-				if len(ca) > 0 {
-					// tentatively do not use ca
-				}
-
-				_, err = client.CoreV1().Secrets(namespace).Update(context.TODO(), &v, v1.UpdateOptions{})
-				if err != nil {
-					logrus.Infof("put tls config to apiserver error: %s", err)
-				} else {
-					logrus.Infof("secret %s is appended with cert and key", v.Name)
-				}
-			}
-		}
-	} else {
-		// only handle this specific secret
-		secret, err := client.CoreV1().Secrets(namespace).Get(context.TODO(), secretName, v1.GetOptions{
-			TypeMeta: v1.TypeMeta{},
-		})
-		if err != nil {
-			return err
-		}
-
-		if len(ca) > 0 {
-			// tentatively do not use ca
-		}
-		if len(string(secret.Data[vars.TlsCrt])) > 0 && len(string(secret.Data[vars.TlsKey])) > 0 {
-			// already update, so no need
-			logrus.Infof("secret %s is already updated with cert and key", secret.Name)
-		} else {
-			secret.Data[vars.TlsCrt] = []byte(crt)
-			secret.Data[vars.TlsKey] = []byte(key)
-			_, err = client.CoreV1().Secrets(namespace).Update(context.TODO(), secret, v1.UpdateOptions{})
-			if err != nil {
-				return fmt.Errorf("put tls config to apiserver error: %s", err)
-			} else {
-				logrus.Infof("secret %s is appended with cert and key", secret.Name)
-			}
-		}
-
-	}
-
-	config.TLSCrt = "/tls.crt"
-	config.TLSKey = "/tls.key"
-	if err = ioutil.WriteFile(config.TLSCrt, crt, 0600); err != nil {
-		return fmt.Errorf("rewrite tls crt file failed: %s", err)
-	}
-	if err = ioutil.WriteFile(config.TLSKey, key, 0600); err != nil {
-		return fmt.Errorf("rewrite tls key file failed: %s", err)
+	reconciler := NewSecretReconciler(client, Namespace(), os.Getenv(vars.SECRET_NAME), os.Getenv(vars.SECRET_SELECTOR))
+	if err = reconciler.Reconcile(ctx, ca, crt, key, overwrite); err != nil {
+		return fmt.Errorf("put tls config to apiserver error: %w", err)
 	}
 	return nil
 }
@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/config"
+)
+
+func TestBootstrapStopsOnCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	cfg := &config.ClientConfig{
+		ConvertUrl: filepath.Join(dir, "url"),
+		Token:      filepath.Join(dir, "token"),
+		Backoff:    config.BackoffConfig{Interval: 10 * time.Millisecond, Multiplier: 1, MaxInterval: 10 * time.Millisecond},
+		// server errors are retried forever
+		BootstrapRetryTimeout: 0,
+	}
+	if err := ioutil.WriteFile(cfg.ConvertUrl, []byte(server.URL), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cfg.Token, []byte("token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, _, _, err := Bootstrap(ctx, cfg)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("bootstrap succeeded against a failing endpoint")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("bootstrap kept retrying after its context was done")
+	}
+}
@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/config"
+)
+
+// RSAKeySize is the size of the RSA keys generated in csr mode.
+const RSAKeySize = 2048
+
+// GenerateKey generates a private key of keyType, ECDSA P-256 if keyType is empty, and returns it along with its PEM
+// encoding.
+func GenerateKey(keyType string) (crypto.Signer, []byte, error) {
+	switch keyType {
+	case config.KeyTypeECDSA, "":
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	case config.KeyTypeRSA:
+		key, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+		if err != nil {
+			return nil, nil, err
+		}
+		der := x509.MarshalPKCS1PrivateKey(key)
+		return key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der}), nil
+	}
+	return nil, nil, fmt.Errorf("unsupported key type %s", keyType)
+}
+
+// NewCSR returns the PEM encoded certificate signing request of the agent of the cluster, signed by key.
+func NewCSR(clusterID string, key crypto.Signer) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: clusterID},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"reflect"
+	"testing"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/config"
+)
+
+func TestNewCSR(t *testing.T) {
+	for _, test := range []struct {
+		keyType   string
+		pemType   string
+		algorithm x509.PublicKeyAlgorithm
+	}{
+		{"", "EC PRIVATE KEY", x509.ECDSA},
+		{config.KeyTypeECDSA, "EC PRIVATE KEY", x509.ECDSA},
+		{config.KeyTypeRSA, "RSA PRIVATE KEY", x509.RSA},
+	} {
+		key, keyPEM, err := GenerateKey(test.keyType)
+		if err != nil {
+			t.Fatalf("%q: %v", test.keyType, err)
+		}
+		block, _ := pem.Decode(keyPEM)
+		if block == nil || block.Type != test.pemType {
+			t.Fatalf("%q: got key PEM %+v, want a %s block", test.keyType, block, test.pemType)
+		}
+		var parsed interface{}
+		switch test.algorithm {
+		case x509.ECDSA:
+			parsed, err = x509.ParseECPrivateKey(block.Bytes)
+		case x509.RSA:
+			parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err == nil && parsed.(*rsa.PrivateKey).N.BitLen() != RSAKeySize {
+				t.Errorf("%q: got %d bits, want %d", test.keyType, parsed.(*rsa.PrivateKey).N.BitLen(), RSAKeySize)
+			}
+		}
+		if err != nil {
+			t.Fatalf("%q: parse key PEM: %v", test.keyType, err)
+		}
+		if !reflect.DeepEqual(parsed, key) {
+			t.Errorf("%q: PEM does not encode the returned key", test.keyType)
+		}
+
+		csrPEM, err := NewCSR("cluster-id", key)
+		if err != nil {
+			t.Fatalf("%q: %v", test.keyType, err)
+		}
+		block, _ = pem.Decode(csrPEM)
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			t.Fatalf("%q: got CSR PEM %+v, want a CERTIFICATE REQUEST block", test.keyType, block)
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			t.Fatalf("%q: %v", test.keyType, err)
+		}
+		if err = csr.CheckSignature(); err != nil {
+			t.Errorf("%q: CSR signature: %v", test.keyType, err)
+		}
+		if csr.Subject.CommonName != "cluster-id" || len(csr.Subject.Organization) != 0 {
+			t.Errorf("%q: got subject %s, want CN=cluster-id", test.keyType, csr.Subject)
+		}
+		if csr.PublicKeyAlgorithm != test.algorithm || !reflect.DeepEqual(csr.PublicKey, key.Public()) {
+			t.Errorf("%q: CSR is not for the generated key", test.keyType)
+		}
+	}
+}
+
+func TestGenerateKeyUnsupported(t *testing.T) {
+	if _, _, err := GenerateKey("dsa"); err == nil {
+		t.Fatal("unsupported key type accepted")
+	}
+}
+
+// the ECDSA keys are P-256, which every TLS stack supports
+func TestGenerateKeyCurve(t *testing.T) {
+	key, _, err := GenerateKey(config.KeyTypeECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := key.(*ecdsa.PrivateKey).Curve.Params().Name; name != "P-256" {
+		t.Fatalf("got curve %s, want P-256", name)
+	}
+}
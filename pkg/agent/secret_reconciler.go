@@ -0,0 +1,161 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/vars"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// DefaultCredentialsSelector is the label selector of the credentials secrets if none is configured.
+	DefaultCredentialsSelector = "ack/credentials=true"
+	// LegacyCredentialsSecret is the secret used before it could be named or selected, manifests of that time neither
+	// set SECRET_NAME nor label it.
+	LegacyCredentialsSecret = "ack-credentials"
+	// LastRotatedAnnotation records when the credentials of a secret were last written.
+	LastRotatedAnnotation = "ack.alibabacloud.com/last-rotated"
+)
+
+var (
+	ErrCredentialsSecretNotFound  = errors.New("credentials secret not found")
+	ErrCredentialsSecretForbidden = errors.New("credentials secret is not accessible")
+)
+
+// SecretReconciler stores the credentials of the agent in the credentials secrets, so they survive restarts.
+type SecretReconciler struct {
+	client    kubernetes.Interface
+	namespace string
+	// name selects a single secret, the secrets matching selector are used otherwise.
+	name     string
+	selector string
+	now      func() time.Time
+}
+
+func NewSecretReconciler(client kubernetes.Interface, namespace, name, selector string) *SecretReconciler {
+	if selector == "" {
+		selector = DefaultCredentialsSelector
+	}
+	return &SecretReconciler{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		selector:  selector,
+		now:       time.Now,
+	}
+}
+
+// Reconcile writes the credentials to every credentials secret. Secrets which already hold a cert and key are left
+// alone unless overwrite is set. Errors wrap ErrCredentialsSecretNotFound or ErrCredentialsSecretForbidden if the
+// secrets are missing or may not be written.
+func (r *SecretReconciler) Reconcile(ctx context.Context, ca, crt, key []byte, overwrite bool) error {
+	names, err := r.discover(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, name := range names {
+		if err := r.reconcile(ctx, name, ca, crt, key, overwrite); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// discover returns the names of the credentials secrets. Listing secrets by selector needs the list permission on
+// secrets, name a single secret instead to only be granted access to it. If no secret matches the selector, or
+// secrets may not be listed, LegacyCredentialsSecret is used if it exists.
+func (r *SecretReconciler) discover(ctx context.Context) ([]string, error) {
+	if r.name != "" {
+		return []string{r.name}, nil
+	}
+	secrets := r.client.CoreV1().Secrets(r.namespace)
+	list, err := secrets.List(ctx, v1.ListOptions{LabelSelector: r.selector})
+	if err != nil && !apierrors.IsForbidden(err) {
+		return nil, r.wrap(r.selector, err)
+	}
+	if err == nil && len(list.Items) > 0 {
+		var names []string
+		for _, secret := range list.Items {
+			names = append(names, secret.Name)
+		}
+		return names, nil
+	}
+	listErr := err
+	if _, err = secrets.Get(ctx, LegacyCredentialsSecret, v1.GetOptions{}); err != nil {
+		if listErr != nil {
+			return nil, r.wrap(r.selector, listErr)
+		}
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: no secret in namespace %s matches %s, and there is no secret %s",
+				ErrCredentialsSecretNotFound, r.namespace, r.selector, LegacyCredentialsSecret)
+		}
+		return nil, r.wrap(LegacyCredentialsSecret, err)
+	}
+	logrus.Warnf("no secret matches %s, using the unlabeled secret %s, label it or set SECRET_NAME", r.selector, LegacyCredentialsSecret)
+	return []string{LegacyCredentialsSecret}, nil
+}
+
+// reconcile patches the credentials into the secret. The patch is guarded by the resource version read before, so
+// concurrent writers are detected and the secret is read and patched again.
+func (r *SecretReconciler) reconcile(ctx context.Context, name string, ca, crt, key []byte, overwrite bool) error {
+	secrets := r.client.CoreV1().Secrets(r.namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := secrets.Get(ctx, name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if !overwrite && len(secret.Data[vars.TlsCrt]) > 0 && len(secret.Data[vars.TlsKey]) > 0 {
+			logrus.Infof("secret %s is already updated with cert and key", name)
+			return nil
+		}
+		data := map[string][]byte{
+			vars.TlsCrt: crt,
+			vars.TlsKey: key,
+		}
+		if len(ca) > 0 {
+			data[vars.RootCa] = ca
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": secret.ResourceVersion,
+				"annotations": map[string]string{
+					LastRotatedAnnotation: r.now().UTC().Format(time.RFC3339),
+				},
+			},
+			"data": data,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = secrets.Patch(ctx, name, types.StrategicMergePatchType, patch, v1.PatchOptions{}); err != nil {
+			return err
+		}
+		logrus.Infof("secret %s is appended with cert and key", name)
+		return nil
+	})
+	if err != nil {
+		return r.wrap(name, err)
+	}
+	return nil
+}
+
+func (r *SecretReconciler) wrap(name string, err error) error {
+	switch {
+	case apierrors.IsNotFound(err):
+		return fmt.Errorf("%w: %s/%s", ErrCredentialsSecretNotFound, r.namespace, name)
+	case apierrors.IsForbidden(err), apierrors.IsUnauthorized(err):
+		return fmt.Errorf("%w: %s/%s: %s", ErrCredentialsSecretForbidden, r.namespace, name, err)
+	}
+	return fmt.Errorf("secret %s/%s: %s", r.namespace, name, err)
+}
@@ -0,0 +1,198 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/vars"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testNamespace = "kube-system"
+
+var testRotated = time.Date(2023, 3, 1, 12, 0, 0, 0, time.FixedZone("CST", 8*60*60))
+
+func newSecret(name string, labels map[string]string, data map[string][]byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: testNamespace, Labels: labels, ResourceVersion: "1"},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       data,
+	}
+}
+
+func newTestReconciler(client *fake.Clientset, name, selector string) *SecretReconciler {
+	r := NewSecretReconciler(client, testNamespace, name, selector)
+	r.now = func() time.Time { return testRotated }
+	return r
+}
+
+func getSecret(t *testing.T, client *fake.Clientset, name string) *corev1.Secret {
+	t.Helper()
+	secret, err := client.CoreV1().Secrets(testNamespace).Get(context.Background(), name, v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// assertCredentials checks that the secret holds the credentials written at testRotated.
+func assertCredentials(t *testing.T, secret *corev1.Secret, ca, crt, key string) {
+	t.Helper()
+	if got := string(secret.Data[vars.RootCa]); got != ca {
+		t.Errorf("secret %s: got ca %q, want %q", secret.Name, got, ca)
+	}
+	if got := string(secret.Data[vars.TlsCrt]); got != crt {
+		t.Errorf("secret %s: got cert %q, want %q", secret.Name, got, crt)
+	}
+	if got := string(secret.Data[vars.TlsKey]); got != key {
+		t.Errorf("secret %s: got key %q, want %q", secret.Name, got, key)
+	}
+	if got := secret.Annotations[LastRotatedAnnotation]; got != "2023-03-01T04:00:00Z" {
+		t.Errorf("secret %s: got %s annotation %q, want %q", secret.Name, LastRotatedAnnotation, got, "2023-03-01T04:00:00Z")
+	}
+}
+
+func TestReconcileSelector(t *testing.T) {
+	labels := map[string]string{"ack/credentials": "true"}
+	client := fake.NewSimpleClientset(
+		newSecret("credentials-a", labels, map[string][]byte{"url": []byte("https://ack")}),
+		newSecret("credentials-b", labels, nil),
+		newSecret("unlabeled", nil, nil),
+		// the legacy secret is only used if no secret matches
+		newSecret(LegacyCredentialsSecret, nil, nil),
+	)
+	r := newTestReconciler(client, "", "")
+	if err := r.Reconcile(context.Background(), []byte("ca"), []byte("crt"), []byte("key"), false); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"credentials-a", "credentials-b"} {
+		assertCredentials(t, getSecret(t, client, name), "ca", "crt", "key")
+	}
+	if got := string(getSecret(t, client, "credentials-a").Data["url"]); got != "https://ack" {
+		t.Errorf("got url %q, want the other keys of the secret to be kept", got)
+	}
+	for _, name := range []string{"unlabeled", LegacyCredentialsSecret} {
+		if secret := getSecret(t, client, name); len(secret.Data) > 0 || len(secret.Annotations) > 0 {
+			t.Errorf("secret %s not matching the selector was written", name)
+		}
+	}
+}
+
+func TestReconcileNoSecretMatches(t *testing.T) {
+	client := fake.NewSimpleClientset(newSecret("ack-credentials-other", nil, nil))
+	err := newTestReconciler(client, "", "").Reconcile(context.Background(), nil, []byte("crt"), []byte("key"), false)
+	if !errors.Is(err, ErrCredentialsSecretNotFound) {
+		t.Fatalf("got error %v, want %v", err, ErrCredentialsSecretNotFound)
+	}
+}
+
+func TestReconcileLegacySecret(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		listForbidden bool
+	}{
+		{"no secret matches", false},
+		{"list forbidden", true},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(newSecret(LegacyCredentialsSecret, nil, nil), newSecret("unlabeled", nil, nil))
+			if test.listForbidden {
+				client.PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "", errors.New("rbac"))
+				})
+			}
+			if err := newTestReconciler(client, "", "").Reconcile(context.Background(), []byte("ca"), []byte("crt"), []byte("key"), false); err != nil {
+				t.Fatal(err)
+			}
+			assertCredentials(t, getSecret(t, client, LegacyCredentialsSecret), "ca", "crt", "key")
+			if secret := getSecret(t, client, "unlabeled"); len(secret.Data) > 0 {
+				t.Error("secret unlabeled was written")
+			}
+		})
+	}
+}
+
+func TestReconcileOverwrite(t *testing.T) {
+	client := fake.NewSimpleClientset(newSecret("ack-credentials", nil, map[string][]byte{
+		vars.TlsCrt: []byte("old-crt"),
+		vars.TlsKey: []byte("old-key"),
+	}))
+	r := newTestReconciler(client, "ack-credentials", "")
+	if err := r.Reconcile(context.Background(), nil, []byte("crt"), []byte("key"), false); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(getSecret(t, client, "ack-credentials").Data[vars.TlsCrt]); got != "old-crt" {
+		t.Fatalf("got cert %q, want the existing cert to be kept without overwrite", got)
+	}
+	if err := r.Reconcile(context.Background(), []byte("ca"), []byte("crt"), []byte("key"), true); err != nil {
+		t.Fatal(err)
+	}
+	assertCredentials(t, getSecret(t, client, "ack-credentials"), "ca", "crt", "key")
+}
+
+func TestReconcileConflict(t *testing.T) {
+	client := fake.NewSimpleClientset(newSecret("ack-credentials", nil, nil))
+	var gets, patches int
+	client.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		return false, nil, nil
+	})
+	client.PrependReactor("patch", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches++
+		if patches == 1 {
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "secrets"}, "ack-credentials", errors.New("the object has been modified"))
+		}
+		return false, nil, nil
+	})
+	r := newTestReconciler(client, "ack-credentials", "")
+	if err := r.Reconcile(context.Background(), []byte("ca"), []byte("crt"), []byte("key"), false); err != nil {
+		t.Fatal(err)
+	}
+	if patches != 2 || gets != 2 {
+		t.Fatalf("got %d gets and %d patches, want the secret to be read and patched again after the conflict", gets, patches)
+	}
+	assertCredentials(t, getSecret(t, client, "ack-credentials"), "ca", "crt", "key")
+}
+
+func TestReconcileErrors(t *testing.T) {
+	forbidden := apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "ack-credentials", errors.New("rbac"))
+	tests := []struct {
+		name     string
+		verb     string
+		secrets  []runtime.Object
+		selector bool
+		want     error
+	}{
+		{"missing", "", nil, false, ErrCredentialsSecretNotFound},
+		{"get forbidden", "get", []runtime.Object{newSecret("ack-credentials", nil, nil)}, false, ErrCredentialsSecretForbidden},
+		{"patch forbidden", "patch", []runtime.Object{newSecret("ack-credentials", nil, nil)}, false, ErrCredentialsSecretForbidden},
+		{"list forbidden", "list", nil, true, ErrCredentialsSecretForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(test.secrets...)
+			if test.verb != "" {
+				client.PrependReactor(test.verb, "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, forbidden
+				})
+			}
+			name := "ack-credentials"
+			if test.selector {
+				name = ""
+			}
+			err := newTestReconciler(client, name, "").Reconcile(context.Background(), nil, []byte("crt"), []byte("key"), false)
+			if !errors.Is(err, test.want) {
+				t.Fatalf("got error %v, want %v", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ErrCAChecksumMismatch is wrapped in a tls.CertificateVerificationError when the stub does not match ACK_CA_CHECKSUM.
+var ErrCAChecksumMismatch = errors.New("no certificate of the stub matches the ca checksum")
+
+// LoadRootCAs reads the CA certificates of the stub from a PEM or DER file. A nil pool is returned without error if
+// the file does not exist or is empty, the system roots are used then.
+func LoadRootCAs(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	roots, err := ParseRootCAs(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return roots, nil
+}
+
+// ParseRootCAs parses PEM or DER encoded CA certificates, a nil pool is returned for empty data.
+func ParseRootCAs(data []byte) (*x509.CertPool, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, nil
+	}
+	roots := x509.NewCertPool()
+	if roots.AppendCertsFromPEM(data) {
+		return roots, nil
+	}
+	certs, err := x509.ParseCertificates(data)
+	if err != nil {
+		return nil, fmt.Errorf("no certificate found: %s", err)
+	}
+	for _, cert := range certs {
+		roots.AddCert(cert)
+	}
+	return roots, nil
+}
+
+// ParseCAChecksum parses the SHA-256 pin of ACK_CA_CHECKSUM, a hex string optionally prefixed with "sha256:".
+func ParseCAChecksum(checksum string) ([]byte, error) {
+	checksum = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(checksum)), "sha256:")
+	pin, err := hex.DecodeString(checksum)
+	if err != nil || len(pin) != sha256.Size {
+		return nil, errors.New("invalid ca checksum, should be the hex encoded sha256 of a certificate or its public key")
+	}
+	return pin, nil
+}
+
+// VerifyCAChecksum returns a tls.Config VerifyConnection function which accepts the stub only if a certificate of
+// its verified chains, usually the CA, has the SHA-256 checksum pin over either the whole certificate or its subject
+// public key info. It runs after the chain and host name have been verified.
+func VerifyCAChecksum(pin []byte) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		for _, chain := range state.VerifiedChains {
+			for _, cert := range chain {
+				certSum := sha256.Sum256(cert.Raw)
+				spkiSum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if bytes.Equal(certSum[:], pin) || bytes.Equal(spkiSum[:], pin) {
+					return nil
+				}
+			}
+		}
+		return &tls.CertificateVerificationError{UnverifiedCertificates: state.PeerCertificates, Err: ErrCAChecksumMismatch}
+	}
+}
@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseCAChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte("ca"))
+	hexSum := hex.EncodeToString(sum[:])
+	for _, test := range []struct {
+		name     string
+		checksum string
+		valid    bool
+	}{
+		{"hex", hexSum, true},
+		{"prefixed", "sha256:" + hexSum, true},
+		{"upper case with spaces", "  SHA256:" + string(bytes.ToUpper([]byte(hexSum))) + "\n", true},
+		{"empty", "", false},
+		{"not hex", "sha256:" + hexSum[:62] + "zz", false},
+		{"too short", hexSum[:62], false},
+		{"too long", hexSum + "00", false},
+		{"other algorithm", "sha1:" + hexSum, false},
+	} {
+		pin, err := ParseCAChecksum(test.checksum)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: %q accepted", test.name, test.checksum)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(pin, sum[:]) {
+			t.Errorf("%s: got %x, %v, want %x", test.name, pin, err, sum)
+		}
+	}
+}
+
+func TestVerifyCAChecksum(t *testing.T) {
+	now := time.Now()
+	caPEM, _ := newTestCert(t, "ca", now.Add(-time.Hour), now.Add(time.Hour))
+	otherPEM, _ := newTestCert(t, "other ca", now.Add(-time.Hour), now.Add(time.Hour))
+	ca := parseTestCert(t, caPEM)
+	other := parseTestCert(t, otherPEM)
+	certSum := sha256.Sum256(ca.Raw)
+	spkiSum := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+
+	for _, test := range []struct {
+		name   string
+		pin    []byte
+		chains [][]*x509.Certificate
+		match  bool
+	}{
+		{"certificate checksum", certSum[:], [][]*x509.Certificate{{other, ca}}, true},
+		{"public key checksum", spkiSum[:], [][]*x509.Certificate{{other, ca}}, true},
+		{"second chain", certSum[:], [][]*x509.Certificate{{other}, {ca}}, true},
+		{"mismatch", certSum[:], [][]*x509.Certificate{{other}}, false},
+		{"no verified chain", certSum[:], nil, false},
+	} {
+		state := tls.ConnectionState{VerifiedChains: test.chains, PeerCertificates: []*x509.Certificate{ca}}
+		err := VerifyCAChecksum(test.pin)(state)
+		if test.match && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.match && !errors.Is(err, ErrCAChecksumMismatch) {
+			t.Errorf("%s: got %v, want %v", test.name, err, ErrCAChecksumMismatch)
+		}
+	}
+}
+
+func TestParseRootCAs(t *testing.T) {
+	now := time.Now()
+	caPEM, _ := newTestCert(t, "ca", now.Add(-time.Hour), now.Add(time.Hour))
+	ca := parseTestCert(t, caPEM)
+	for _, test := range []struct {
+		name  string
+		data  []byte
+		roots bool
+		valid bool
+	}{
+		{"pem", caPEM, true, true},
+		{"der", ca.Raw, true, true},
+		{"empty", []byte(" \n"), false, true},
+		{"garbage", []byte("not a certificate"), false, false},
+	} {
+		roots, err := ParseRootCAs(test.data)
+		if (err == nil) != test.valid || (roots != nil) != test.roots {
+			t.Errorf("%s: got roots %t, error %v", test.name, roots != nil, err)
+		}
+	}
+}
+
+func parseTestCert(t *testing.T, data []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
@@ -0,0 +1,197 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/logging"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+)
+
+// Level is how much of a request is recorded.
+type Level string
+
+const (
+	// LevelNone disables auditing.
+	LevelNone Level = "None"
+	// LevelMetadata records who did what and the outcome, but no bodies.
+	LevelMetadata Level = "Metadata"
+	// LevelRequest also records the request bodies of mutating verbs.
+	LevelRequest Level = "Request"
+
+	// MaxBodySize bounds the recorded request body, larger bodies are truncated.
+	MaxBodySize = 64 * 1024
+
+	// StdoutPath writes the audit log to stdout.
+	StdoutPath = "-"
+)
+
+// ParseLevel parses the level case-insensitively.
+func ParseLevel(level string) (Level, error) {
+	for _, l := range []Level{LevelNone, LevelMetadata, LevelRequest} {
+		if strings.EqualFold(level, string(l)) {
+			return l, nil
+		}
+	}
+	return "", fmt.Errorf("unknown audit level %s, should be one of None, Metadata and Request", level)
+}
+
+// Event is an audit record of a session, written as a JSON line.
+type Event struct {
+	Timestamp time.Time `json:"timestamp"`
+	SessionID uint16    `json:"sessionID"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	// User and Groups are the identity ACK impersonates with the request.
+	User    string   `json:"user,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	Upgrade string   `json:"upgrade,omitempty"`
+	// Status is the status code of the api server, 0 if it did not respond.
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// DurationMillis is the time from receiving the request until the session finished.
+	DurationMillis int64 `json:"durationMillis"`
+	// RequestBytes counts the request body as it is read, whatever its Content-Length says. RequestBytes and
+	// ResponseBytes include the traffic piped through upgraded sessions.
+	RequestBytes  int64           `json:"requestBytes"`
+	ResponseBytes int64           `json:"responseBytes"`
+	RequestBody   json.RawMessage `json:"requestBody,omitempty"`
+	// RequestBodyTruncated is set if the body exceeded MaxBodySize or is no JSON, RequestBody holds a string then.
+	RequestBodyTruncated bool `json:"requestBodyTruncated,omitempty"`
+
+	body *countingBody
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.read, int64(n))
+	return n, err
+}
+
+// Logger writes audit events as JSON lines. A nil *Logger records nothing.
+type Logger struct {
+	level  Level
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+// NewLogger writes events of level to path, StdoutPath for stdout. Files are rotated once they reach maxSizeMB,
+// keeping maxBackups old files. nil is returned for LevelNone.
+func NewLogger(level Level, path string, maxSizeMB, maxBackups int) *Logger {
+	if level == LevelNone || level == "" {
+		return nil
+	}
+	var writer io.Writer = os.Stdout
+	if path != "" && path != StdoutPath {
+		writer = &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    maxSizeMB,
+			MaxBackups: maxBackups,
+			Compress:   true,
+		}
+	}
+	return &Logger{level: level, writer: writer}
+}
+
+// NewEvent starts the record of a session. The request body is replaced to count the bytes read from it, and read
+// right away if it is to be recorded.
+func (l *Logger) NewEvent(sessionID uint16, request *http.Request) *Event {
+	if l == nil {
+		return nil
+	}
+	event := &Event{
+		Timestamp: time.Now(),
+		SessionID: sessionID,
+		Method:    request.Method,
+		URI:       logging.DefaultRedactor.Redact(request.URL.RequestURI()),
+		User:      request.Header.Get("Impersonate-User"),
+		Groups:    request.Header.Values("Impersonate-Group"),
+	}
+	if httpstream.IsUpgradeRequest(request) {
+		event.Upgrade = request.Header.Get("Upgrade")
+	}
+	if l.level == LevelRequest && isMutating(request.Method) && request.Body != nil {
+		body, err := ioutil.ReadAll(request.Body)
+		request.Body.Close()
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err == nil && len(body) > 0 {
+			event.setBody(body, request.URL.Path)
+		}
+	}
+	// a body replaced although it is empty would be sent chunked, as the transport could no longer tell it is empty
+	if request.Body != nil && request.Body != http.NoBody && request.ContentLength != 0 {
+		event.body = &countingBody{ReadCloser: request.Body}
+		request.Body = event.body
+	}
+	return event
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// setBody records the body with the secrets it carries redacted.
+func (e *Event) setBody(body []byte, path string) {
+	if len(body) <= MaxBodySize && json.Valid(body) {
+		e.RequestBody = redactBody(body, path)
+		return
+	}
+	if len(body) > MaxBodySize {
+		body = body[:MaxBodySize]
+	}
+	e.RequestBodyTruncated = true
+	quoted, _ := json.Marshal(logging.DefaultRedactor.Redact(string(body)))
+	e.RequestBody = quoted
+}
+
+// Finish records the outcome of the session.
+func (e *Event) Finish(status int, err error, requestBytes, responseBytes int64) {
+	if e == nil {
+		return
+	}
+	e.Status = status
+	if err != nil {
+		e.Error = logging.DefaultRedactor.Redact(err.Error())
+	}
+	e.DurationMillis = time.Since(e.Timestamp).Milliseconds()
+	if e.body != nil {
+		e.RequestBytes += atomic.LoadInt64(&e.body.read)
+	}
+	e.RequestBytes += requestBytes
+	e.ResponseBytes += responseBytes
+}
+
+// Log writes the event.
+func (l *Logger) Log(event *Event) {
+	if l == nil || event == nil {
+		return
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.writer.Write(line)
+}
@@ -0,0 +1,40 @@
+package audit
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEventCountsRequestBytes(t *testing.T) {
+	logger := &Logger{level: LevelMetadata, writer: ioutil.Discard}
+	for _, test := range []struct {
+		name          string
+		body          io.Reader
+		contentLength int64
+		want          int64
+	}{
+		{"no body", nil, 0, 0},
+		{"content length", strings.NewReader("hello world"), 11, 11},
+		{"chunked", strings.NewReader("hello world"), -1, 11},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodPost, "/api/v1/namespaces/default/configmaps", test.body)
+			request.ContentLength = test.contentLength
+			event := logger.NewEvent(1, request)
+			if test.body == nil && request.Body != nil {
+				t.Fatal("empty body replaced")
+			}
+			if request.Body != nil {
+				io.Copy(ioutil.Discard, request.Body)
+			}
+			// bytes piped after an upgrade are added
+			event.Finish(http.StatusOK, nil, 3, 5)
+			if event.RequestBytes != test.want+3 || event.ResponseBytes != 5 {
+				t.Fatalf("got %d request and %d response bytes, want %d and 5", event.RequestBytes, event.ResponseBytes, test.want+3)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package audit
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/logging"
+)
+
+// secretFields hold the payload of Secrets, and of ConfigMaps which often carry credentials as well.
+var secretFields = []string{"data", "stringData", "binaryData"}
+
+// redactBody masks the payload of Secrets and ConfigMaps, including those inside lists and patches of their paths,
+// and runs the log redaction over all other strings.
+func redactBody(body []byte, path string) json.RawMessage {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return body
+	}
+	secretPath := strings.Contains(path, "/secrets") || strings.Contains(path, "/configmaps")
+	redacted, err := json.Marshal(redactValue(value, secretPath))
+	if err != nil {
+		return body
+	}
+	return redacted
+}
+
+func redactValue(value interface{}, secret bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if kind, _ := v["kind"].(string); kind == "Secret" || kind == "ConfigMap" {
+			secret = true
+		}
+		for key, field := range v {
+			if secret && isSecretField(key) {
+				v[key] = logging.Redacted
+				continue
+			}
+			v[key] = redactValue(field, secret)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item, secret)
+		}
+		return v
+	case string:
+		return logging.DefaultRedactor.Redact(v)
+	}
+	return value
+}
+
+func isSecretField(key string) bool {
+	for _, field := range secretFields {
+		if key == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package clockskew
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MaxSkew is how far the local clock may be off the clocks of ACK before certificates and signed requests are
+// rejected.
+const MaxSkew = 5 * time.Minute
+
+// SkewError is returned by Check when the local clock is off by more than MaxSkew.
+type SkewError struct {
+	// Skew is how far the local clock is ahead, negative if it is behind.
+	Skew time.Duration
+	// Source tells where the skew was observed.
+	Source string
+}
+
+func (e *SkewError) Error() string {
+	direction := "ahead of"
+	skew := e.Skew
+	if skew < 0 {
+		direction, skew = "behind", -skew
+	}
+	return fmt.Sprintf("local clock is %s %s %s, check that NTP is running on the node", skew.Round(time.Second), direction, e.Source)
+}
+
+// Detector tracks the skew of the local clock observed in responses and certificates of remote peers.
+type Detector struct {
+	lock     sync.RWMutex
+	skew     time.Duration
+	source   string
+	observed time.Time
+	now      func() time.Time
+}
+
+// Default is the detector shared by the bootstrap client and the stub connector.
+var Default = NewDetector()
+
+func NewDetector() *Detector {
+	return &Detector{now: time.Now}
+}
+
+// ObserveResponse records the skew against the Date header of resp, if it has one.
+func (d *Detector) ObserveResponse(source string, resp *http.Response) (time.Duration, bool) {
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, false
+	}
+	// the Date header is truncated to seconds
+	skew := d.now().Sub(date)
+	if skew > 0 && skew < time.Second {
+		skew = 0
+	}
+	d.observe(source, skew)
+	return skew, true
+}
+
+// ObserveCertificate records a skew if cert is not valid yet, which means the local clock is behind the issuer.
+// Valid certificates clear an earlier skew observed from source.
+func (d *Detector) ObserveCertificate(source string, cert *x509.Certificate) {
+	if behind := cert.NotBefore.Sub(d.now()); behind > 0 {
+		d.observe(source, -behind)
+		return
+	}
+	d.Clear(source)
+}
+
+// ObserveVerifyError records the skew behind a certificate which failed verification for not being valid yet.
+func (d *Detector) ObserveVerifyError(source string, err error) bool {
+	var invalidErr x509.CertificateInvalidError
+	if !errors.As(err, &invalidErr) || invalidErr.Reason != x509.Expired || invalidErr.Cert == nil {
+		return false
+	}
+	if !d.now().Before(invalidErr.Cert.NotBefore) {
+		// the certificate has really expired, or the clock is ahead, which cannot be told apart
+		return false
+	}
+	d.ObserveCertificate(source, invalidErr.Cert)
+	return true
+}
+
+// Clear records that source agrees with the local clock, e.g. after a successful handshake.
+func (d *Detector) Clear(source string) {
+	d.observe(source, 0)
+}
+
+func (d *Detector) observe(source string, skew time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.source != source && abs(skew) <= MaxSkew && abs(d.skew) > MaxSkew {
+		// only the source which reported the skew can clear it
+		return
+	}
+	if abs(skew) > MaxSkew && abs(d.skew) <= MaxSkew {
+		logrus.Warn((&SkewError{Skew: skew, Source: source}).Error())
+	}
+	d.skew, d.source, d.observed = skew, source, d.now()
+}
+
+// Skew returns the last skew observed and where.
+func (d *Detector) Skew() (time.Duration, string) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.skew, d.source
+}
+
+// Check returns a *SkewError if the local clock is off by more than MaxSkew.
+func (d *Detector) Check() error {
+	skew, source := d.Skew()
+	if abs(skew) > MaxSkew {
+		return &SkewError{Skew: skew, Source: source}
+	}
+	return nil
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
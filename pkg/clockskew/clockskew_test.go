@@ -0,0 +1,126 @@
+package clockskew
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestDetector() *Detector {
+	return newTestDetectorAt(testNow)
+}
+
+func newTestDetectorAt(now time.Time) *Detector {
+	return &Detector{now: func() time.Time { return now }}
+}
+
+func responseWithDate(date time.Time) *http.Response {
+	resp := &http.Response{Header: http.Header{}}
+	if !date.IsZero() {
+		resp.Header.Set("Date", date.UTC().Format(http.TimeFormat))
+	}
+	return resp
+}
+
+func TestObserveResponse(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		now      time.Time
+		date     time.Time
+		observed bool
+		skew     time.Duration
+		skewed   bool
+	}{
+		{"no date", testNow, time.Time{}, false, 0, false},
+		{"in sync", testNow, testNow, true, 0, false},
+		{"truncated to seconds", testNow.Add(900 * time.Millisecond), testNow, true, 0, false},
+		{"behind within max skew", testNow, testNow.Add(MaxSkew), true, -MaxSkew, false},
+		{"behind", testNow, testNow.Add(MaxSkew + time.Minute), true, -MaxSkew - time.Minute, true},
+		{"ahead", testNow, testNow.Add(-MaxSkew - time.Minute), true, MaxSkew + time.Minute, true},
+	} {
+		d := newTestDetectorAt(test.now)
+		skew, observed := d.ObserveResponse("ack", responseWithDate(test.date))
+		if observed != test.observed || skew != test.skew {
+			t.Errorf("%s: got %s %t, want %s %t", test.name, skew, observed, test.skew, test.observed)
+		}
+		err := d.Check()
+		var skewErr *SkewError
+		if test.skewed != errors.As(err, &skewErr) {
+			t.Errorf("%s: got check error %v, want skewed %t", test.name, err, test.skewed)
+		}
+		if test.skewed && (skewErr.Skew != test.skew || skewErr.Source != "ack") {
+			t.Errorf("%s: got %+v", test.name, skewErr)
+		}
+	}
+}
+
+func TestObserveCertificate(t *testing.T) {
+	d := newTestDetector()
+	d.ObserveCertificate("stub", &x509.Certificate{NotBefore: testNow.Add(10 * time.Minute)})
+	if skew, source := d.Skew(); skew != -10*time.Minute || source != "stub" {
+		t.Fatalf("certificate not valid yet: got %s from %q", skew, source)
+	}
+	d.ObserveCertificate("stub", &x509.Certificate{NotBefore: testNow.Add(-time.Hour)})
+	if err := d.Check(); err != nil {
+		t.Fatalf("valid certificate of the source did not clear the skew: %v", err)
+	}
+}
+
+func TestObserveVerifyError(t *testing.T) {
+	notYetValid := &x509.Certificate{NotBefore: testNow.Add(10 * time.Minute), NotAfter: testNow.Add(time.Hour)}
+	expired := &x509.Certificate{NotBefore: testNow.Add(-time.Hour), NotAfter: testNow.Add(-time.Minute)}
+	for _, test := range []struct {
+		name     string
+		err      error
+		observed bool
+	}{
+		{"not valid yet", x509.CertificateInvalidError{Cert: notYetValid, Reason: x509.Expired}, true},
+		{"wrapped", fmt.Errorf("handshake: %w", x509.CertificateInvalidError{Cert: notYetValid, Reason: x509.Expired}), true},
+		{"expired", x509.CertificateInvalidError{Cert: expired, Reason: x509.Expired}, false},
+		{"other reason", x509.CertificateInvalidError{Cert: notYetValid, Reason: x509.NotAuthorizedToSign}, false},
+		{"unknown authority", x509.UnknownAuthorityError{}, false},
+	} {
+		d := newTestDetector()
+		if observed := d.ObserveVerifyError("stub", test.err); observed != test.observed {
+			t.Errorf("%s: got observed %t, want %t", test.name, observed, test.observed)
+		}
+		if skewed := d.Check() != nil; skewed != test.observed {
+			t.Errorf("%s: got skewed %t, want %t", test.name, skewed, test.observed)
+		}
+	}
+}
+
+// Only the source which reported a skew clears it, others agreeing with the local clock do not.
+func TestClearOnlyByReportingSource(t *testing.T) {
+	d := newTestDetector()
+	d.ObserveResponse("ack", responseWithDate(testNow.Add(time.Hour)))
+
+	d.Clear("stub")
+	d.ObserveResponse("other", responseWithDate(testNow))
+	if err := d.Check(); err == nil {
+		t.Fatal("skew cleared by a source which did not report it")
+	}
+	if _, source := d.Skew(); source != "ack" {
+		t.Fatalf("got source %q, want ack", source)
+	}
+
+	// a larger skew of another source replaces it
+	d.ObserveResponse("stub", responseWithDate(testNow.Add(2*time.Hour)))
+	if skew, source := d.Skew(); skew != -2*time.Hour || source != "stub" {
+		t.Fatalf("got %s from %q, want -2h from stub", skew, source)
+	}
+	d.Clear("ack")
+	if err := d.Check(); err == nil {
+		t.Fatal("skew of stub cleared by ack")
+	}
+
+	d.Clear("stub")
+	if err := d.Check(); err != nil {
+		t.Fatalf("skew not cleared by the reporting source: %v", err)
+	}
+}
@@ -3,12 +3,16 @@ package config
 import (
 	"errors"
 	"fmt"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/audit"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/utils"
 	"github.com/alibaba/alibabacloud-ack-connector/pkg/vars"
 	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -19,6 +23,28 @@ const (
 	kubernetesServicePortKey = "KUBERNETES_SERVICE_PORT"
 	kubernetesProto          = "https"
 	tunnelsPerAgentKey       = "TUNNELS_PER_AGENT"
+	tunnelMultiplexKey       = "TUNNEL_MULTIPLEX"
+	maxSessionsPerTunnelKey  = "MAX_SESSIONS_PER_TUNNEL"
+	maxRequestBodySizeKey    = "MAX_REQUEST_BODY_SIZE"
+	frameInspectionKey       = "TUNNEL_FRAME_INSPECTION"
+	maxFrameSizeKey          = "TUNNEL_MAX_FRAME_SIZE"
+	shutdownGracePeriodKey   = "SHUTDOWN_GRACE_PERIOD"
+	stubTransportKey         = "STUB_TRANSPORT"
+	stubWebsocketURLKey      = "STUB_WEBSOCKET_URL"
+	certRenewBeforeKey       = "CERT_RENEW_BEFORE"
+	certBootstrapModeKey     = "CERT_BOOTSTRAP_MODE"
+	certKeyTypeKey           = "CERT_KEY_TYPE"
+	credentialsDirKey        = "CREDENTIALS_DIR"
+	tokenModeKey             = "BOOTSTRAP_TOKEN_MODE"
+	bootstrapTimeoutKey      = "BOOTSTRAP_TIMEOUT"
+	bootstrapRetryTimeoutKey = "BOOTSTRAP_RETRY_TIMEOUT"
+	auditLevelKey            = "AUDIT_LEVEL"
+	auditLogPathKey          = "AUDIT_LOG_PATH"
+	auditLogMaxSizeKey       = "AUDIT_LOG_MAX_SIZE"
+	auditLogMaxBackupsKey    = "AUDIT_LOG_MAX_BACKUPS"
+	policyFileKey            = "POLICY_FILE"
+	policyConfigMapKey       = "POLICY_CONFIGMAP"
+	policyConfigMapKeyKey    = "POLICY_CONFIGMAP_KEY"
 )
 
 func LoadClientConfigFromEnv() (*ClientConfig, error) {
@@ -53,18 +79,96 @@ func LoadClientConfigFromEnv() (*ClientConfig, error) {
 	c.TLSCrt = getPath(vars.TlsCrt)
 	c.TLSKey = getPath(vars.TlsKey)
 	c.RootCA = getPath(vars.RootCa)
+	c.CredentialsDir = os.Getenv(credentialsDirKey)
+	c.CAChecksum = os.Getenv(vars.CAChecksum)
+	if c.CertRenewBefore, err = getDuration(certRenewBeforeKey, 0, false); err != nil {
+		return nil, err
+	}
+	c.CertBootstrapMode = CertBootstrapDownload
+	if mode := os.Getenv(certBootstrapModeKey); mode != "" {
+		switch mode {
+		case CertBootstrapDownload, CertBootstrapCSR:
+			c.CertBootstrapMode = mode
+		default:
+			return nil, fmt.Errorf("%s: unknown mode %s, should be one of download and csr", certBootstrapModeKey, mode)
+		}
+	}
+	c.CertKeyType = KeyTypeECDSA
+	if keyType := os.Getenv(certKeyTypeKey); keyType != "" {
+		switch keyType {
+		case KeyTypeECDSA, KeyTypeRSA:
+			c.CertKeyType = keyType
+		default:
+			return nil, fmt.Errorf("%s: unknown key type %s, should be one of ecdsa and rsa", certKeyTypeKey, keyType)
+		}
+	}
 	c.Tunnel = k8stun
 	c.ConvertUrl = getPath(vars.ConvertUrl)
 	c.Token = getPath(vars.ConnectToken)
-	tunnelsPerAgentStr, err := getEnv(tunnelsPerAgentKey)
-	if err != nil {
-		c.TunnelsPerAgent = 1
+	c.TokenMode = TokenModeHeader
+	if mode := os.Getenv(tokenModeKey); mode != "" {
+		switch mode {
+		case TokenModeHeader, TokenModeQuery:
+			c.TokenMode = mode
+		default:
+			return nil, fmt.Errorf("%s: unknown mode %s, should be one of header and query", tokenModeKey, mode)
+		}
 	}
-	tunnelsPerAgent, err := strconv.Atoi(tunnelsPerAgentStr)
-	if err != nil {
-		c.TunnelsPerAgent = 1
-	} else {
-		c.TunnelsPerAgent = tunnelsPerAgent
+	if c.BootstrapTimeout, err = getDuration(bootstrapTimeoutKey, DefaultBootstrapTimeout, false); err != nil {
+		return nil, err
+	}
+	if c.BootstrapRetryTimeout, err = getDuration(bootstrapRetryTimeoutKey, DefaultBootstrapRetryTimeout, true); err != nil {
+		return nil, err
+	}
+	if c.TunnelsPerAgent, err = getInt(tunnelsPerAgentKey, 1, false); err != nil {
+		return nil, err
+	}
+	if c.Multiplex, err = getBool(tunnelMultiplexKey, true); err != nil {
+		return nil, err
+	}
+	if c.MaxSessionsPerTunnel, err = getInt(maxSessionsPerTunnelKey, DefaultMaxSessionsPerTunnel, false); err != nil {
+		return nil, err
+	}
+	if c.MaxRequestBodySize, err = getInt64(maxRequestBodySizeKey, base.DefaultMaxRequestBodySize, false); err != nil {
+		return nil, err
+	}
+	if c.FrameInspection, err = getBool(frameInspectionKey, false); err != nil {
+		return nil, err
+	}
+	if c.MaxFrameSize, err = getInt(maxFrameSizeKey, 0, false); err != nil {
+		return nil, err
+	}
+	if c.ShutdownGracePeriod, err = getDuration(shutdownGracePeriodKey, DefaultShutdownGracePeriod, true); err != nil {
+		return nil, err
+	}
+	c.Transport = base.TransportTLS
+	if transport := os.Getenv(stubTransportKey); transport != "" {
+		switch transport {
+		case base.TransportTLS, base.TransportWebsocket, base.TransportAuto:
+			c.Transport = transport
+		default:
+			return nil, fmt.Errorf("%s: unknown transport %s, should be one of tls, websocket and auto", stubTransportKey, transport)
+		}
+	}
+	c.WebsocketURL = os.Getenv(stubWebsocketURLKey)
+	c.AuditLevel = audit.LevelNone
+	if level := os.Getenv(auditLevelKey); level != "" {
+		if c.AuditLevel, err = audit.ParseLevel(level); err != nil {
+			return nil, fmt.Errorf("%s: %s", auditLevelKey, err)
+		}
+	}
+	c.AuditLogPath = os.Getenv(auditLogPathKey)
+	if c.AuditLogMaxSize, err = getInt(auditLogMaxSizeKey, DefaultAuditLogMaxSize, false); err != nil {
+		return nil, err
+	}
+	if c.AuditLogMaxBackups, err = getInt(auditLogMaxBackupsKey, DefaultAuditLogMaxBackups, true); err != nil {
+		return nil, err
+	}
+	c.PolicyFile = os.Getenv(policyFileKey)
+	c.PolicyConfigMap = os.Getenv(policyConfigMapKey)
+	c.PolicyConfigMapKey = os.Getenv(policyConfigMapKeyKey)
+	if c.PolicyFile != "" && c.PolicyConfigMap != "" {
+		return nil, fmt.Errorf("%s and %s are mutually exclusive", policyFileKey, policyConfigMapKey)
 	}
 	return &c, nil
 }
@@ -77,6 +181,62 @@ func getEnv(env string) (string, error) {
 	return value, nil
 }
 
+// getBool returns the boolean value of env, or def if it is empty.
+func getBool(env string, def bool) (bool, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s: invalid boolean %s", env, value)
+	}
+	return b, nil
+}
+
+// getInt64 returns the integer value of env, or def if it is empty. Values of zero or less, or less than zero if
+// allowZero is set, are an error.
+func getInt64(env string, def int64, allowZero bool) (int64, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return def, nil
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid integer %s", env, value)
+	}
+	if i < 0 || i == 0 && !allowZero {
+		return 0, fmt.Errorf("%s: %d is out of range", env, i)
+	}
+	return i, nil
+}
+
+// getInt is getInt64 for values of type int.
+func getInt(env string, def int, allowZero bool) (int, error) {
+	i, err := getInt64(env, int64(def), allowZero)
+	if err == nil && int64(int(i)) != i {
+		return 0, fmt.Errorf("%s: %d is out of range", env, i)
+	}
+	return int(i), err
+}
+
+// getDuration returns the duration value of env, or def if it is empty. Durations of zero or less, or less than zero
+// if allowZero is set, are an error.
+func getDuration(env string, def time.Duration, allowZero bool) (time.Duration, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid duration %s", env, value)
+	}
+	if d < 0 || d == 0 && !allowZero {
+		return 0, fmt.Errorf("%s: %s is out of range", env, d)
+	}
+	return d, nil
+}
+
 func getPath(key string) string {
 	return path.Join(vars.AliyunCredentialsFolder, key)
 }
@@ -100,6 +260,7 @@ func GetK8sTunnelFromENV() (*Tunnel, error) {
 	if err := populateCAData(cfg); err != nil {
 		return nil, err
 	}
+	cfg.Proxy = utils.NoProxy
 
 	kubernetesServiceHost, err := getEnv(kubernetesServiceHostKey)
 	if err != nil {
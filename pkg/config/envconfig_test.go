@@ -0,0 +1,72 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+const testEnvKey = "TEST_ENVCONFIG_VALUE"
+
+func TestGetInt(t *testing.T) {
+	for _, test := range []struct {
+		value     string
+		allowZero bool
+		want      int
+		valid     bool
+	}{
+		{"", false, 10, true},
+		{"3", false, 3, true},
+		{"0", true, 0, true},
+		{"0", false, 0, false},
+		{"-1", true, 0, false},
+		{"3x", false, 0, false},
+		{"1.5", false, 0, false},
+	} {
+		t.Setenv(testEnvKey, test.value)
+		got, err := getInt(testEnvKey, 10, test.allowZero)
+		if (err == nil) != test.valid || got != test.want {
+			t.Errorf("%q, allow zero %t: got %d, %v", test.value, test.allowZero, got, err)
+		}
+	}
+}
+
+func TestGetDuration(t *testing.T) {
+	for _, test := range []struct {
+		value     string
+		allowZero bool
+		want      time.Duration
+		valid     bool
+	}{
+		{"", false, time.Minute, true},
+		{"30s", false, 30 * time.Second, true},
+		{"0", true, 0, true},
+		{"0s", false, 0, false},
+		{"-1s", true, 0, false},
+		{"30", false, 0, false},
+	} {
+		t.Setenv(testEnvKey, test.value)
+		got, err := getDuration(testEnvKey, time.Minute, test.allowZero)
+		if (err == nil) != test.valid || got != test.want {
+			t.Errorf("%q, allow zero %t: got %s, %v", test.value, test.allowZero, got, err)
+		}
+	}
+}
+
+func TestGetBool(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  bool
+		valid bool
+	}{
+		{"", true, true},
+		{"false", false, true},
+		{"0", false, true},
+		{"no", false, false},
+	} {
+		t.Setenv(testEnvKey, test.value)
+		got, err := getBool(testEnvKey, true)
+		if (err == nil) != test.valid || got != test.want {
+			t.Errorf("%q: got %t, %v", test.value, got, err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"time"
 
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/audit"
 	"k8s.io/client-go/rest"
 )
 
@@ -11,6 +12,30 @@ const (
 	DefaultBackoffMultiplier  = 1.5
 	DefaultBackoffMaxInterval = 10 * time.Second
 	DefaultBackoffMaxTime     = 0
+
+	DefaultMaxSessionsPerTunnel = 100
+	DefaultShutdownGracePeriod  = 25 * time.Second
+
+	DefaultBootstrapTimeout      = 30 * time.Second
+	DefaultBootstrapRetryTimeout = 5 * time.Minute
+
+	DefaultAuditLogMaxSize    = 100
+	DefaultAuditLogMaxBackups = 5
+)
+
+const (
+	// CertBootstrapDownload downloads the private key along with the certificate.
+	CertBootstrapDownload = "download"
+	// CertBootstrapCSR generates the private key locally and only submits a CSR.
+	CertBootstrapCSR = "csr"
+
+	KeyTypeECDSA = "ecdsa"
+	KeyTypeRSA   = "rsa"
+
+	// TokenModeHeader sends the bootstrap token in the Authorization header.
+	TokenModeHeader = "header"
+	// TokenModeQuery sends the bootstrap token as query parameter, for endpoints predating the header.
+	TokenModeQuery = "query"
 )
 
 const (
@@ -35,10 +60,26 @@ type Tunnel struct {
 }
 
 type ClientConfig struct {
-	ServerAddr      string
-	TLSCrt          string
-	TLSKey          string
-	RootCA          string
+	ServerAddr string
+	TLSCrt     string
+	TLSKey     string
+	RootCA     string
+	// TLSCrtData, TLSKeyData and RootCAData hold bootstrapped credentials in memory, they take precedence over the
+	// files.
+	TLSCrtData []byte
+	TLSKeyData []byte
+	RootCAData []byte
+	// CredentialsDir is a writable directory, e.g. an emptyDir, bootstrapped credentials are also written to. They
+	// are only kept in memory if it is empty.
+	CredentialsDir string
+	// CertRenewBefore renews the client certificate this long before it expires, after 2/3 of its lifetime if 0.
+	CertRenewBefore time.Duration
+	// CertBootstrapMode is how the client certificate is obtained, CertBootstrapDownload or CertBootstrapCSR.
+	CertBootstrapMode string
+	// CertKeyType is the type of the private key generated in csr mode, KeyTypeECDSA or KeyTypeRSA.
+	CertKeyType string
+	// CAChecksum pins the stub certificate chain by the SHA-256 of a certificate or its public key, if set.
+	CAChecksum      string
 	Backoff         BackoffConfig
 	ClusterID       string
 	KubeConfig      string
@@ -46,4 +87,42 @@ type ClientConfig struct {
 	ConvertUrl      string
 	Token           string
 	TunnelsPerAgent int
+	Multiplex       bool
+	// MaxSessionsPerTunnel bounds the sessions in flight on each tunnel.
+	MaxSessionsPerTunnel int
+	// MaxRequestBodySize is the largest request body accepted from the stub, larger requests are answered with 413.
+	MaxRequestBodySize int64
+	// FrameInspection pipes SPDY and websocket traffic frame by frame.
+	FrameInspection bool
+	// MaxFrameSize is the largest frame accepted by frame inspection.
+	MaxFrameSize int
+	// ShutdownGracePeriod is how long sessions in flight may run after SIGTERM, it should be shorter than the
+	// terminationGracePeriodSeconds of the pod.
+	ShutdownGracePeriod time.Duration
+	// Transport carries the connections to the stub: tls, websocket, or auto which switches between both when
+	// dialing fails repeatedly.
+	Transport string
+	// WebsocketURL is the wss:// endpoint of the stub, derived from ServerAddr if empty.
+	WebsocketURL string
+	// TokenMode is how the bootstrap token is sent, TokenModeHeader or TokenModeQuery.
+	TokenMode string
+	// BootstrapTimeout bounds each request to the certificate endpoint.
+	BootstrapTimeout time.Duration
+	// BootstrapRetryTimeout is how long network and server errors of the certificate endpoint are retried.
+	BootstrapRetryTimeout time.Duration
+	// AuditLevel is how much of the proxied requests is recorded in the audit log, audit.LevelNone disables it.
+	AuditLevel audit.Level
+	// AuditLogPath is the file the audit log is written to, stdout if it is empty or audit.StdoutPath.
+	AuditLogPath string
+	// AuditLogMaxSize is the size in megabytes at which the audit log file is rotated.
+	AuditLogMaxSize int
+	// AuditLogMaxBackups is how many rotated audit log files are kept.
+	AuditLogMaxBackups int
+	// PolicyFile is the file of the request policy, see policy.Policy.
+	PolicyFile string
+	// PolicyConfigMap is the ConfigMap in the namespace of the agent holding the request policy under
+	// PolicyConfigMapKey, policy.DefaultConfigMapKey if it is empty. No policy is applied if neither it nor PolicyFile
+	// is set.
+	PolicyConfigMap    string
+	PolicyConfigMapKey string
 }
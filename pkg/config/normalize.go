@@ -29,7 +29,7 @@ func getAddress(addr string) (string, error) {
 func getURL(rawurl string) (string, error) {
 	list := strings.SplitN(rawurl, "://", 2)
 	if len(list) > 1 {
-		if list[0] != HTTP || list[0] != HTTPS {
+		if list[0] != HTTP && list[0] != HTTPS {
 			return "", fmt.Errorf("unsupported url schema, only 'http' or 'https' is allowed")
 		}
 	} else {
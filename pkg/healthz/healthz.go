@@ -0,0 +1,93 @@
+package healthz
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// HealthChecker is a named check of the health of the agent.
+type HealthChecker interface {
+	Name() string
+	Check(req *http.Request) error
+}
+
+type healthzCheck struct {
+	name  string
+	check func(req *http.Request) error
+}
+
+func (c *healthzCheck) Name() string {
+	return c.name
+}
+
+func (c *healthzCheck) Check(req *http.Request) error {
+	return c.check(req)
+}
+
+// NamedCheck returns a HealthChecker running check.
+func NamedCheck(name string, check func(req *http.Request) error) HealthChecker {
+	return &healthzCheck{name: name, check: check}
+}
+
+// PingHealthz always passes, it tells the server is up.
+var PingHealthz = NamedCheck("ping", func(*http.Request) error { return nil })
+
+// InstallPathHandler serves the checks on path, and each check on path/<name>. The result of every check is listed
+// with the verbose query parameter, checks can be skipped with exclude=<name>.
+func InstallPathHandler(mux *http.ServeMux, path string, checks ...HealthChecker) {
+	mux.Handle(path, handleRootHealth(path, checks))
+	for _, check := range checks {
+		mux.Handle(fmt.Sprintf("%s/%s", path, check.Name()), adaptCheck(check))
+	}
+}
+
+func handleRootHealth(path string, checks []HealthChecker) http.HandlerFunc {
+	name := strings.TrimPrefix(path, "/")
+	return func(rw http.ResponseWriter, req *http.Request) {
+		excluded := map[string]bool{}
+		for _, name := range req.URL.Query()["exclude"] {
+			excluded[strings.TrimSpace(name)] = true
+		}
+		var output bytes.Buffer
+		var failed []string
+		for _, check := range checks {
+			if excluded[check.Name()] {
+				fmt.Fprintf(&output, "[+]%s excluded: ok\n", check.Name())
+				continue
+			}
+			if err := check.Check(req); err != nil {
+				fmt.Fprintf(&output, "[-]%s failed: %v\n", check.Name(), err)
+				failed = append(failed, check.Name())
+				continue
+			}
+			fmt.Fprintf(&output, "[+]%s ok\n", check.Name())
+		}
+
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		rw.Header().Set("X-Content-Type-Options", "nosniff")
+		if len(failed) > 0 {
+			rw.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(&output, "%s check failed: %s\n", name, strings.Join(failed, ","))
+			output.WriteTo(rw)
+			return
+		}
+		if _, verbose := req.URL.Query()["verbose"]; !verbose {
+			fmt.Fprint(rw, "ok")
+			return
+		}
+		fmt.Fprintf(&output, "%s check passed\n", name)
+		output.WriteTo(rw)
+	}
+}
+
+func adaptCheck(check HealthChecker) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if err := check.Check(req); err != nil {
+			http.Error(rw, fmt.Sprintf("internal server error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(rw, "ok")
+	}
+}
@@ -11,6 +11,8 @@ import (
 func NewLogger(level int) *logrus.Logger {
 	logger := logrus.New()
 	logger.SetReportCaller(true)
+	// tokens, keys and certificates must not end up in the log pipelines
+	InstallRedaction(logger)
 	logger.Formatter = &logrus.TextFormatter{
 		CallerPrettyfier: func(f *runtime.Frame) (string, string) {
 			filename := utils.TrimStrAndPre(f.File, "/src/github.com/alibaba/alibabacloud-ack-connector")
@@ -0,0 +1,119 @@
+package logging
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Redacted replaces secrets in log messages and fields.
+const Redacted = "[REDACTED]"
+
+var (
+	pemPattern = regexp.MustCompile(`-----BEGIN [A-Z0-9 ]+-----[\s\S]*?(-----END [A-Z0-9 ]+-----|$)`)
+	// query parameters and key=value pairs carrying secrets, e.g. &token=...
+	paramPattern = regexp.MustCompile(`(?i)\b((?:access_)?token|password|passwd|secret|private_?key)=[^&\s"',;]+`)
+	// credentials of Authorization and Proxy-Authorization headers, as written by http.Header or on the wire
+	authHeaderPattern = regexp.MustCompile(`(?i)(\b(?:proxy-)?authorization["']?\s*[:=]\s*["'\[]*(?:(?:bearer|basic)\s+)?)[^\s"',;\]]+`)
+	// bearer tokens elsewhere, only runs of token length so that prose like "bearer of" is kept
+	bearerPattern = regexp.MustCompile(`(?i)\b(bearer\s+)[A-Za-z0-9\-._~+/]{20,}=*`)
+	// userinfo of URLs, e.g. proxy credentials
+	userinfoPattern = regexp.MustCompile(`(://[^/@\s:]+):[^/@\s]+@`)
+)
+
+// sensitiveFields are the names of fields whose values are always redacted, compared case-insensitively.
+var sensitiveFields = []string{
+	"token", "access_token", "bootstrap_token", "password", "passwd", "secret", "client_secret",
+	"authorization", "proxy-authorization", "private_key", "tls.key", "cert", "tls.crt",
+}
+
+// Redactor is a logrus hook masking tokens, keys and certificates in the message and fields of every entry.
+type Redactor struct {
+	lock sync.RWMutex
+	// secrets are exact values to mask wherever they appear, e.g. the bootstrap token.
+	secrets []string
+}
+
+// DefaultRedactor is installed on the loggers created by NewLogger and on the standard logger.
+var DefaultRedactor = &Redactor{}
+
+var installOnce sync.Once
+
+// InstallRedaction adds DefaultRedactor to logger and to the standard logger of logrus.
+func InstallRedaction(logger *logrus.Logger) {
+	logger.AddHook(DefaultRedactor)
+	installOnce.Do(func() {
+		logrus.AddHook(DefaultRedactor)
+	})
+}
+
+// AddSecret masks every occurrence of secret from now on.
+func (r *Redactor) AddSecret(secret string) {
+	secret = strings.TrimSpace(secret)
+	if len(secret) < 4 {
+		// too short to be told apart from regular text
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, s := range r.secrets {
+		if s == secret {
+			return
+		}
+	}
+	r.secrets = append(r.secrets, secret)
+}
+
+func (r *Redactor) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (r *Redactor) Fire(entry *logrus.Entry) error {
+	entry.Message = r.Redact(entry.Message)
+	for name, value := range entry.Data {
+		if isSensitiveField(name) {
+			entry.Data[name] = Redacted
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			entry.Data[name] = r.Redact(v)
+		case error:
+			if redacted := r.Redact(v.Error()); redacted != v.Error() {
+				entry.Data[name] = redacted
+			}
+		case fmt.Stringer:
+			if redacted := r.Redact(v.String()); redacted != v.String() {
+				entry.Data[name] = redacted
+			}
+		}
+	}
+	return nil
+}
+
+// Redact masks the secrets in s.
+func (r *Redactor) Redact(s string) string {
+	r.lock.RLock()
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, Redacted)
+	}
+	r.lock.RUnlock()
+	s = pemPattern.ReplaceAllString(s, Redacted)
+	s = paramPattern.ReplaceAllString(s, "$1="+Redacted)
+	s = authHeaderPattern.ReplaceAllString(s, "$1"+Redacted)
+	s = bearerPattern.ReplaceAllString(s, "$1"+Redacted)
+	s = userinfoPattern.ReplaceAllString(s, "$1:"+Redacted+"@")
+	return s
+}
+
+func isSensitiveField(name string) bool {
+	for _, field := range sensitiveFields {
+		if strings.EqualFold(name, field) {
+			return true
+		}
+	}
+	return false
+}
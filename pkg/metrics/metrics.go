@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/clockskew"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ack_connector"
+
+var (
+	// StubConnectAttempts counts the dials to the stub by connection type, see ConnType.
+	StubConnectAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "stub",
+		Name:      "connect_attempts_total",
+		Help:      "Number of dials to the stub by connection type.",
+	}, []string{"type"})
+	// StubConnectFailures counts the failed dials to the stub by connection type.
+	StubConnectFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "stub",
+		Name:      "connect_failures_total",
+		Help:      "Number of failed dials to the stub by connection type.",
+	}, []string{"type"})
+	// TunnelsUp is the number of tunnels registered with the stub.
+	TunnelsUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "tunnel",
+		Name:      "up",
+		Help:      "Number of tunnels registered with the stub.",
+	})
+	// TunnelReconnects counts the tunnels registered again after they failed.
+	TunnelReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "tunnel",
+		Name:      "reconnects_total",
+		Help:      "Number of times a failed tunnel was registered again.",
+	})
+	// HeartbeatClusterHealthy is 1 if the last cluster check of the heartbeat passed, 0 otherwise.
+	HeartbeatClusterHealthy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "heartbeat",
+		Name:      "cluster_healthy",
+		Help:      "Whether the last cluster check reported by the heartbeat passed.",
+	})
+	// HeartbeatFailures counts the heartbeats which could not be sent to the stub.
+	HeartbeatFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "heartbeat",
+		Name:      "failures_total",
+		Help:      "Number of heartbeats which could not be sent to the stub.",
+	})
+	// SessionsActive is the number of upgraded sessions being piped by upgrade type.
+	SessionsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "session",
+		Name:      "active",
+		Help:      "Number of upgraded sessions being piped by upgrade type.",
+	}, []string{"upgrade"})
+	// PipedBytes counts the bytes piped through upgraded sessions, forward is from the stub to the api server.
+	PipedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "session",
+		Name:      "piped_bytes_total",
+		Help:      "Bytes piped through upgraded sessions, forward is from the stub to the api server.",
+	}, []string{"direction"})
+	// APIServerRequestDuration is the latency of the requests to the api server until the response header arrived.
+	APIServerRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "apiserver",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of requests to the api server until the response header arrived, by verb and status code.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"verb", "code"})
+	// PolicyDenials counts the requests denied by the request policy, by rule and whether it is in dry run mode.
+	PolicyDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "policy",
+		Name:      "denials_total",
+		Help:      "Requests denied by the request policy, by rule and whether they were forwarded in dry run mode.",
+	}, []string{"rule", "dry_run"})
+	// ClockSkew is the skew of the local clock against ACK, positive if it is ahead.
+	ClockSkew = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "clock_skew_seconds",
+		Help:      "Skew of the local clock against ACK, positive if the local clock is ahead.",
+	}, func() float64 {
+		skew, _ := clockskew.Default.Skew()
+		return skew.Seconds()
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		StubConnectAttempts,
+		StubConnectFailures,
+		TunnelsUp,
+		TunnelReconnects,
+		HeartbeatClusterHealthy,
+		HeartbeatFailures,
+		SessionsActive,
+		PipedBytes,
+		APIServerRequestDuration,
+		PolicyDenials,
+		ClockSkew,
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// UpgradeType maps the Upgrade header to the upgrade label, keeping its cardinality bounded.
+func UpgradeType(protocol string) string {
+	protocol = strings.ToLower(protocol)
+	switch {
+	case strings.HasPrefix(protocol, "spdy/"):
+		return "spdy"
+	case protocol == "websocket":
+		return "websocket"
+	}
+	return "other"
+}
+
+// CountingWriter adds the bytes written through it to a counter, if any.
+type CountingWriter struct {
+	Writer  io.Writer
+	Counter prometheus.Counter
+	written int64
+}
+
+func (w *CountingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if w.Counter != nil {
+		w.Counter.Add(float64(n))
+	}
+	atomic.AddInt64(&w.written, int64(n))
+	return n, err
+}
+
+// Written returns the bytes written so far, it is safe to call while writing.
+func (w *CountingWriter) Written() int64 {
+	return atomic.LoadInt64(&w.written)
+}
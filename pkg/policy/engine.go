@@ -0,0 +1,150 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/metrics"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/requestinfo"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// ReloadInterval is how often the policy is loaded again to pick up changes.
+	ReloadInterval = 30 * time.Second
+	// DefaultConfigMapKey is the key of the policy in its ConfigMap.
+	DefaultConfigMapKey = "policy.yaml"
+)
+
+// Loader returns the current policy document.
+type Loader func(ctx context.Context) ([]byte, error)
+
+// FileLoader reads the policy from a file, e.g. a mounted ConfigMap.
+func FileLoader(path string) Loader {
+	return func(context.Context) ([]byte, error) {
+		return ioutil.ReadFile(path)
+	}
+}
+
+// ConfigMapLoader reads the policy from the key of a ConfigMap.
+func ConfigMapLoader(client kubernetes.Interface, namespace, name, key string) Loader {
+	if key == "" {
+		key = DefaultConfigMapKey
+	}
+	return func(ctx context.Context) ([]byte, error) {
+		configMap, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		data, ok := configMap.Data[key]
+		if !ok {
+			return nil, fmt.Errorf("configmap %s/%s has no key %s", namespace, name, key)
+		}
+		return []byte(data), nil
+	}
+}
+
+// Decision is the outcome of evaluating a request.
+type Decision struct {
+	// Allowed is whether the request is forwarded to the api server.
+	Allowed bool
+	// DryRun is set if the request is forwarded although the policy denies it.
+	DryRun bool
+	// Rule is the name of the rule deciding the request, empty for the default action.
+	Rule       string
+	Attributes *requestinfo.RequestInfo
+}
+
+// Message explains a denial to the user of the request.
+func (d Decision) Message() string {
+	reason := "the default action"
+	if d.Rule != "" {
+		reason = "rule " + d.Rule
+	}
+	return fmt.Sprintf("%s is forbidden by the policy of the ack connector (%s)", d.Attributes, reason)
+}
+
+// Engine evaluates requests against the current policy. A nil *Engine allows everything.
+type Engine struct {
+	logger *logrus.Logger
+	load   Loader
+	// policy is the current *Policy, it is replaced as a whole on reload.
+	policy atomic.Value
+	// data is the document of the current policy, to skip reloads which change nothing.
+	data []byte
+}
+
+// NewEngine loads the policy, an error is returned if it cannot be loaded or is invalid.
+func NewEngine(ctx context.Context, logger *logrus.Logger, load Loader) (*Engine, error) {
+	e := &Engine{logger: logger, load: load}
+	if err := e.reload(ctx); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Run reloads the policy every ReloadInterval until ctx is done. The current policy stays in effect if the new one
+// cannot be loaded or is invalid.
+func (e *Engine) Run(ctx context.Context) {
+	ticker := time.NewTicker(ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := e.reload(ctx); err != nil && ctx.Err() == nil {
+			e.logger.Errorf("reload request policy failed, keep the current one: %s", err)
+		}
+	}
+}
+
+func (e *Engine) reload(ctx context.Context) error {
+	data, err := e.load(ctx)
+	if err != nil {
+		return fmt.Errorf("load request policy: %w", err)
+	}
+	if e.data != nil && bytes.Equal(data, e.data) {
+		return nil
+	}
+	policy, err := Parse(data)
+	if err != nil {
+		return err
+	}
+	e.data = data
+	e.policy.Store(policy)
+	e.logger.Infof("request policy loaded, %d rules, mode %s, default action %s", len(policy.Rules), policy.Mode, policy.DefaultAction)
+	return nil
+}
+
+// Evaluate decides whether the request described by attrs may be forwarded, in dry run mode denied requests are
+// allowed anyway.
+func (e *Engine) Evaluate(attrs *requestinfo.RequestInfo) Decision {
+	if e == nil {
+		return Decision{Allowed: true}
+	}
+	policy := e.policy.Load().(*Policy)
+	action, rule := policy.Evaluate(attrs)
+	decision := Decision{Allowed: action == ActionAllow, Rule: rule, Attributes: attrs}
+	if decision.Allowed {
+		return decision
+	}
+	dryRun := policy.Mode == ModeDryRun
+	ruleLabel := rule
+	if ruleLabel == "" {
+		ruleLabel = "defaultAction"
+	}
+	metrics.PolicyDenials.WithLabelValues(ruleLabel, strconv.FormatBool(dryRun)).Inc()
+	if dryRun {
+		decision.Allowed, decision.DryRun = true, true
+	}
+	return decision
+}
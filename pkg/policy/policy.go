@@ -0,0 +1,174 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/requestinfo"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Mode is how denials of a policy are handled.
+type Mode string
+
+const (
+	// ModeEnforce rejects denied requests.
+	ModeEnforce Mode = "enforce"
+	// ModeDryRun only logs denied requests and forwards them anyway, to try out a policy.
+	ModeDryRun Mode = "dryRun"
+)
+
+type Action string
+
+const (
+	ActionAllow Action = "allow"
+	ActionDeny  Action = "deny"
+)
+
+// Policy is a list of rules evaluated in order, the first rule matching a request decides it. Requests no rule
+// matches get DefaultAction.
+//
+//	mode: enforce
+//	defaultAction: allow
+//	rules:
+//	- name: no-exec
+//	  action: deny
+//	  resources: ["pods/exec", "pods/attach"]
+//	- name: no-secret-reads
+//	  action: deny
+//	  verbs: ["get", "list", "watch"]
+//	  resources: ["secrets"]
+type Policy struct {
+	Mode          Mode   `json:"mode,omitempty"`
+	DefaultAction Action `json:"defaultAction,omitempty"`
+	Rules         []Rule `json:"rules,omitempty"`
+}
+
+// Rule matches requests by all of its fields, an empty field matches anything. Patterns are matched exactly, "*"
+// matches anything, a trailing "*" matches by prefix and resources like "*/exec" match a subresource of any resource.
+type Rule struct {
+	Name   string `json:"name,omitempty"`
+	Action Action `json:"action"`
+	// Users and Groups match the impersonated user and any of the impersonated groups.
+	Users      []string `json:"users,omitempty"`
+	Groups     []string `json:"groups,omitempty"`
+	Verbs      []string `json:"verbs,omitempty"`
+	APIGroups  []string `json:"apiGroups,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Resources match the resource with its subresource, e.g. "pods" does not match "pods/log".
+	Resources []string `json:"resources,omitempty"`
+	// NonResourceURLs match the path of requests outside /api and /apis. A rule with NonResourceURLs matches no
+	// resource requests, a rule with APIGroups, Namespaces or Resources matches no other requests.
+	NonResourceURLs []string `json:"nonResourceURLs,omitempty"`
+}
+
+// Parse parses a policy in YAML or JSON and fills in the defaults.
+func Parse(data []byte) (*Policy, error) {
+	policy := &Policy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("invalid policy: %s", err)
+	}
+	if policy.Mode == "" {
+		policy.Mode = ModeEnforce
+	}
+	if policy.Mode != ModeEnforce && policy.Mode != ModeDryRun {
+		return nil, fmt.Errorf("invalid policy: unknown mode %s, should be one of enforce and dryRun", policy.Mode)
+	}
+	if policy.DefaultAction == "" {
+		policy.DefaultAction = ActionAllow
+	}
+	if err := validateAction(policy.DefaultAction); err != nil {
+		return nil, fmt.Errorf("invalid policy: defaultAction: %s", err)
+	}
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if err := validateAction(rule.Action); err != nil {
+			return nil, fmt.Errorf("invalid policy: rule %s: %s", rule.Name, err)
+		}
+		if len(rule.NonResourceURLs) > 0 && rule.matchesResourcesOnly() {
+			return nil, fmt.Errorf("invalid policy: rule %s: nonResourceURLs cannot be combined with apiGroups, namespaces or resources", rule.Name)
+		}
+		for j, verb := range rule.Verbs {
+			rule.Verbs[j] = strings.ToLower(verb)
+		}
+	}
+	return policy, nil
+}
+
+func validateAction(action Action) error {
+	switch action {
+	case ActionAllow, ActionDeny:
+		return nil
+	case "":
+		return errors.New("missing action")
+	}
+	return fmt.Errorf("unknown action %s, should be one of allow and deny", action)
+}
+
+// Evaluate returns the action for the request and the name of the rule deciding it, empty for the default action.
+func (p *Policy) Evaluate(attrs *requestinfo.RequestInfo) (Action, string) {
+	for i := range p.Rules {
+		if p.Rules[i].Matches(attrs) {
+			return p.Rules[i].Action, p.Rules[i].Name
+		}
+	}
+	return p.DefaultAction, ""
+}
+
+// Matches reports whether the rule applies to the request.
+func (r *Rule) Matches(attrs *requestinfo.RequestInfo) bool {
+	if attrs.ResourceRequest {
+		if len(r.NonResourceURLs) > 0 {
+			return false
+		}
+	} else if r.matchesResourcesOnly() {
+		return false
+	}
+	if !matchAny(r.Users, attrs.User) || !matchGroups(r.Groups, attrs.Groups) || !matchAny(r.Verbs, attrs.Verb) {
+		return false
+	}
+	if !attrs.ResourceRequest {
+		return matchAny(r.NonResourceURLs, attrs.Path)
+	}
+	return matchAny(r.APIGroups, attrs.APIGroup) && matchAny(r.Namespaces, attrs.Namespace) &&
+		matchAny(r.Resources, attrs.ResourcePath())
+}
+
+func (r *Rule) matchesResourcesOnly() bool {
+	return len(r.APIGroups) > 0 || len(r.Namespaces) > 0 || len(r.Resources) > 0
+}
+
+func matchGroups(patterns, groups []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, group := range groups {
+		if matchAny(patterns, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether value matches one of the patterns, or there are no patterns at all.
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		switch {
+		case pattern == "*" || pattern == value:
+			return true
+		case strings.HasPrefix(pattern, "*/") && strings.HasSuffix(value, pattern[1:]):
+			return true
+		case strings.HasSuffix(pattern, "*") && strings.HasPrefix(value, pattern[:len(pattern)-1]):
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,32 @@
+package policy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/requestinfo"
+)
+
+// A deny rule for all resources does not block discovery.
+func TestDiscoveryNotDeniedByResourceRule(t *testing.T) {
+	policy, err := Parse([]byte(`
+defaultAction: allow
+rules:
+  - name: deny-all-resources
+    action: deny
+    resources: ["*"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/api", "/api/v1", "/apis", "/apis/apps/v1"} {
+		request, _ := http.NewRequest(http.MethodGet, path, nil)
+		if action, rule := policy.Evaluate(requestinfo.New(request)); action != ActionAllow {
+			t.Errorf("%s: denied by %q", path, rule)
+		}
+	}
+	request, _ := http.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+	if action, _ := policy.Evaluate(requestinfo.New(request)); action != ActionDeny {
+		t.Error("/api/v1/pods: not denied")
+	}
+}
@@ -0,0 +1,141 @@
+// Package requestinfo tells what a request to the api server does, for the policy engine and the metrics alike.
+package requestinfo
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RequestInfo describes a request to the api server the way the api server itself authorizes it.
+type RequestInfo struct {
+	// User and Groups are the identity the request impersonates, empty if it does not.
+	User   string
+	Groups []string
+	// Verb is the kubernetes verb of resource requests, e.g. list or deletecollection, and the lowercase HTTP method
+	// of other requests.
+	Verb string
+	// ResourceRequest is false for requests outside /api and /apis, e.g. /healthz or /version.
+	ResourceRequest bool
+	Path            string
+	APIGroup        string
+	Namespace       string
+	Resource        string
+	Subresource     string
+	Name            string
+}
+
+// New parses the path of the request like the RequestInfo of the api server:
+//
+//	/api/{version}/namespaces/{namespace}/{resource}/{name}/{subresource}
+//	/apis/{group}/{version}/{resource}/{name}/{subresource}
+//
+// Other paths, including /api/{version} and /apis/{group}/{version} without a resource, are non-resource requests.
+func New(request *http.Request) *RequestInfo {
+	info := &RequestInfo{
+		User:   request.Header.Get("Impersonate-User"),
+		Groups: request.Header.Values("Impersonate-Group"),
+		Path:   request.URL.Path,
+		Verb:   strings.ToLower(request.Method),
+	}
+	parts := splitPath(request.URL.Path)
+	switch {
+	// shorter paths do not name a resource, e.g. the discovery of /api/v1 or /apis/apps/v1
+	case len(parts) >= 3 && parts[0] == "api":
+		parts = parts[2:]
+	case len(parts) >= 4 && parts[0] == "apis":
+		info.APIGroup = parts[1]
+		parts = parts[3:]
+	default:
+		return info
+	}
+	info.ResourceRequest = true
+
+	var specialVerb string
+	if len(parts) >= 2 && (parts[0] == "watch" || parts[0] == "proxy") {
+		// deprecated paths, e.g. /api/v1/watch/pods
+		specialVerb = parts[0]
+		parts = parts[1:]
+	}
+	if len(parts) >= 2 && parts[0] == "namespaces" {
+		info.Namespace = parts[1]
+		// the status and finalize subresources of the namespace itself
+		if len(parts) > 2 && parts[2] != "status" && parts[2] != "finalize" {
+			parts = parts[2:]
+		}
+	}
+	if len(parts) > 0 {
+		info.Resource = parts[0]
+	}
+	if len(parts) > 1 {
+		info.Name = parts[1]
+	}
+	// anything after the name of a proxy request is the proxied path
+	if len(parts) > 2 && specialVerb != "proxy" {
+		info.Subresource = parts[2]
+	}
+	if specialVerb != "" {
+		info.Verb = specialVerb
+		return info
+	}
+
+	switch request.Method {
+	case http.MethodGet, http.MethodHead:
+		info.Verb = "get"
+		if info.Name == "" {
+			info.Verb = "list"
+			if watch, _ := strconv.ParseBool(request.URL.Query().Get("watch")); watch {
+				info.Verb = "watch"
+			}
+		}
+	case http.MethodPost:
+		info.Verb = "create"
+	case http.MethodPut:
+		info.Verb = "update"
+	case http.MethodPatch:
+		info.Verb = "patch"
+	case http.MethodDelete:
+		info.Verb = "delete"
+		if info.Name == "" {
+			info.Verb = "deletecollection"
+		}
+	}
+	return info
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// ResourcePath returns the resource with its subresource, e.g. pods/exec.
+func (a *RequestInfo) ResourcePath() string {
+	if a.Subresource != "" {
+		return a.Resource + "/" + a.Subresource
+	}
+	return a.Resource
+}
+
+func (a *RequestInfo) String() string {
+	user := a.User
+	if user == "" {
+		user = "<none>"
+	}
+	if !a.ResourceRequest {
+		return "user " + user + " " + a.Verb + " " + a.Path
+	}
+	s := "user " + user + " " + a.Verb + " " + a.ResourcePath()
+	if a.APIGroup != "" {
+		s += "." + a.APIGroup
+	}
+	if a.Name != "" {
+		s += " " + a.Name
+	}
+	if a.Namespace != "" {
+		s += " in namespace " + a.Namespace
+	}
+	return s
+}
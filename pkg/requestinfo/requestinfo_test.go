@@ -0,0 +1,122 @@
+package requestinfo
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// The cases are those of the RequestInfoFactory tests of the api server.
+func TestNewResourceRequest(t *testing.T) {
+	tests := []struct {
+		method      string
+		url         string
+		verb        string
+		apiGroup    string
+		namespace   string
+		resource    string
+		subresource string
+		name        string
+	}{
+		{"GET", "/api/v1/namespaces", "list", "", "", "namespaces", "", ""},
+		{"GET", "/api/v1/namespaces/other", "get", "", "other", "namespaces", "", "other"},
+
+		{"GET", "/api/v1/namespaces/other/pods", "list", "", "other", "pods", "", ""},
+		{"GET", "/api/v1/namespaces/other/pods/foo", "get", "", "other", "pods", "", "foo"},
+		{"HEAD", "/api/v1/namespaces/other/pods/foo", "get", "", "other", "pods", "", "foo"},
+		{"GET", "/api/v1/pods", "list", "", "", "pods", "", ""},
+		{"HEAD", "/api/v1/pods", "list", "", "", "pods", "", ""},
+
+		// special verbs
+		{"GET", "/api/v1/proxy/namespaces/other/pods/foo", "proxy", "", "other", "pods", "", "foo"},
+		{"GET", "/api/v1/proxy/namespaces/other/pods/foo/subpath/not/a/subresource", "proxy", "", "other", "pods", "", "foo"},
+		{"GET", "/api/v1/watch/pods", "watch", "", "", "pods", "", ""},
+		{"GET", "/api/v1/pods?watch=true", "watch", "", "", "pods", "", ""},
+		{"GET", "/api/v1/pods?watch=false", "list", "", "", "pods", "", ""},
+		{"GET", "/api/v1/watch/namespaces/other/pods", "watch", "", "other", "pods", "", ""},
+		{"GET", "/api/v1/namespaces/other/pods?watch=1", "watch", "", "other", "pods", "", ""},
+		{"GET", "/api/v1/namespaces/other/pods?watch=0", "list", "", "other", "pods", "", ""},
+
+		// subresource identification
+		{"GET", "/api/v1/namespaces/other/pods/foo/status", "get", "", "other", "pods", "status", "foo"},
+		{"GET", "/api/v1/namespaces/other/pods/foo/proxy/subpath", "get", "", "other", "pods", "proxy", "foo"},
+		{"PUT", "/api/v1/namespaces/other/finalize", "update", "", "other", "namespaces", "finalize", "other"},
+		{"PUT", "/api/v1/namespaces/other/status", "update", "", "other", "namespaces", "status", "other"},
+
+		// verb identification
+		{"PATCH", "/api/v1/namespaces/other/pods/foo", "patch", "", "other", "pods", "", "foo"},
+		{"DELETE", "/api/v1/namespaces/other/pods/foo", "delete", "", "other", "pods", "", "foo"},
+		{"POST", "/api/v1/namespaces/other/pods", "create", "", "other", "pods", "", ""},
+
+		// deletecollection verb identification
+		{"DELETE", "/api/v1/nodes", "deletecollection", "", "", "nodes", "", ""},
+		{"DELETE", "/api/v1/namespaces", "deletecollection", "", "", "namespaces", "", ""},
+		{"DELETE", "/api/v1/namespaces/other/pods", "deletecollection", "", "other", "pods", "", ""},
+		{"DELETE", "/apis/extensions/v1/namespaces/other/pods", "deletecollection", "extensions", "other", "pods", "", ""},
+
+		// api group identification
+		{"POST", "/apis/extensions/v1/namespaces/other/pods", "create", "extensions", "other", "pods", "", ""},
+
+		// api version identification
+		{"POST", "/apis/extensions/v1beta3/namespaces/other/pods", "create", "extensions", "other", "pods", "", ""},
+	}
+	for _, test := range tests {
+		request, _ := http.NewRequest(test.method, test.url, nil)
+		info := New(request)
+		if !info.ResourceRequest {
+			t.Errorf("%s %s: not a resource request", test.method, test.url)
+			continue
+		}
+		want := RequestInfo{
+			Verb:        test.verb,
+			APIGroup:    test.apiGroup,
+			Namespace:   test.namespace,
+			Resource:    test.resource,
+			Subresource: test.subresource,
+			Name:        test.name,
+		}
+		got := RequestInfo{
+			Verb:        info.Verb,
+			APIGroup:    info.APIGroup,
+			Namespace:   info.Namespace,
+			Resource:    info.Resource,
+			Subresource: info.Subresource,
+			Name:        info.Name,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s %s: got %+v, want %+v", test.method, test.url, got, want)
+		}
+	}
+}
+
+func TestNewNonResourceRequest(t *testing.T) {
+	tests := map[string]struct {
+		url             string
+		resourceRequest bool
+	}{
+		"simple groupless":  {"/api/version/resource", true},
+		"simple group":      {"/apis/group/version/resource/name/subresource", true},
+		"more steps":        {"/api/version/resource/name/subresource", true},
+		"group list":        {"/apis/batch/v1/job", true},
+		"group get":         {"/apis/batch/v1/job/foo", true},
+		"group subresource": {"/apis/batch/v1/job/foo/scale", true},
+
+		"bad root":                     {"/not-api/version/resource", false},
+		"group without enough steps":   {"/apis/extensions/v1beta1", false},
+		"group without enough steps 2": {"/apis/extensions/v1beta1/", false},
+		"not enough steps":             {"/api/version", false},
+		"one step":                     {"/api", false},
+		"zero step":                    {"/", false},
+		"empty":                        {"", false},
+	}
+	for name, test := range tests {
+		request, _ := http.NewRequest(http.MethodGet, "http://apiserver"+test.url, nil)
+		info := New(request)
+		if info.ResourceRequest != test.resourceRequest {
+			t.Errorf("%s: %s got resource request %t, want %t", name, test.url, info.ResourceRequest, test.resourceRequest)
+		}
+		if !test.resourceRequest && info.Verb != "get" {
+			t.Errorf("%s: %s got verb %q, want get", name, test.url, info.Verb)
+		}
+	}
+}
@@ -2,15 +2,25 @@ package agent
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/metrics"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/requestinfo"
 	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/alibaba/alibabacloud-ack-connector/pkg/utils"
 
 	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/httpstream"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/transport"
 )
@@ -20,45 +30,103 @@ type KubernetesClientManager struct {
 	base.Component
 	config *rest.Config
 	target *url.URL
+	// transportConfig and tlsConfig are used to dial a hijackable connection for each upgrade request.
+	transportConfig *transport.Config
+	tlsConfig       *tls.Config
+	// roundTripper is shared by all other requests, it keeps connections to the api server alive and speaks HTTP/2
+	// when the api server supports it.
+	roundTripper http.RoundTripper
 }
 
-func NewKubernetesClientManager(ctx context.Context, logger *logrus.Logger, config *rest.Config, target *url.URL) KubernetesClientManager {
-	return KubernetesClientManager{
-		Component: base.NewComponent(ctx, logger),
-		config:    config,
-		target:    target,
+func NewKubernetesClientManager(ctx context.Context, logger *logrus.Logger, config *rest.Config, target *url.URL) (*KubernetesClientManager, error) {
+	transportConfig, err := config.TransportConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := transport.TLSConfigFor(transportConfig)
+	if err != nil {
+		return nil, err
+	}
+	roundTripper, err := rest.TransportFor(config)
+	if err != nil {
+		return nil, err
 	}
+	return &KubernetesClientManager{
+		Component:       base.NewComponent(ctx, logger),
+		config:          config,
+		target:          target,
+		transportConfig: transportConfig,
+		tlsConfig:       tlsConfig,
+		roundTripper:    roundTripper,
+	}, nil
 }
 
-// Do function will automatically create new http client and do http request. The connection is hijacked and hold when
-// response is successfully returned. If any error exists, no connection or response returned. The close of hijacked
-// connection should be processed by function return value receiver.
-func (kcm *KubernetesClientManager) Do(sessionID uint16, r *http.Request) (net.Conn, *http.Response, error) {
+// Do function sends the request to the api server. Upgrade requests are sent over a new connection which is
+// hijacked and hold when response is successfully returned, all other requests share keep-alive connections and
+// no connection is returned for them. If any error exists, no connection or response returned. The close of
+// hijacked connection and response body should be processed by function return value receiver.
+// The request is aborted when its context is done, which tears down watches and log streams of a canceled session.
+// The trace of the request context is propagated to the api server with the traceparent header. info describes the
+// request as sent by the stub, before it is redirected to the target.
+func (kcm *KubernetesClientManager) Do(sessionID uint16, r *http.Request, info *requestinfo.RequestInfo) (conn net.Conn, resp *http.Response, err error) {
 	logger := kcm.Logger.WithField(base.SessionIDHeaderKey, sessionID)
-	transportConfig, err := kcm.config.TransportConfig()
-	if err != nil {
-		logger.Debug("cannot create transport config: ", err)
-		return nil, nil, err
+	utils.RedirectRequest(r, kcm.target)
+	ctx, span := tracing.Tracer().Start(r.Context(), "apiserver", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.Int(tracing.SessionIDKey, int(sessionID)),
+		semconv.HTTPMethodKey.String(r.Method),
+		semconv.HTTPURLKey.String(r.URL.String()),
+	))
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+		}
+		tracing.EndSpan(span, err)
+	}()
+	r = r.WithContext(ctx)
+	tracing.Inject(ctx, r.Header)
+	start := time.Now()
+	if httpstream.IsUpgradeRequest(r) {
+		conn, resp, err = kcm.doUpgrade(logger, r)
+		observeRequest(info, resp, start)
+		return conn, resp, err
 	}
-	tlsConfig, err := transport.TLSConfigFor(transportConfig)
+	logger.Trace("sending redirected request to api server: ", r.URL.String())
+	resp, err = kcm.roundTripper.RoundTrip(r)
+	observeRequest(info, resp, start)
 	if err != nil {
-		logger.Debug("cannot create tls config: ", err)
+		logger.Debug("do request failed: ", err)
 		return nil, nil, err
 	}
-	tlsRoundTripper, err := NewTLSRoundTripper(tlsConfig, kcm.target.Host)
+	// the response is written back to the stub as HTTP/1.1 even if it was received over HTTP/2
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	return nil, resp, nil
+}
+
+// observeRequest records the latency of the request by verb and status code, which is "error" if there is no
+// response. The verb is the kubernetes verb of the request, e.g. list or watch.
+func observeRequest(info *requestinfo.RequestInfo, resp *http.Response, start time.Time) {
+	code := "error"
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	metrics.APIServerRequestDuration.WithLabelValues(info.Verb, code).Observe(time.Since(start).Seconds())
+}
+
+func (kcm *KubernetesClientManager) doUpgrade(logger *logrus.Entry, r *http.Request) (net.Conn, *http.Response, error) {
+	tlsRoundTripper, err := NewTLSRoundTripper(r.Context(), kcm.tlsConfig, kcm.target.Host)
 	if err != nil {
 		logger.Debug("cannot create tlsRoundTripper: ", err)
 		return nil, nil, err
 	}
-	_transport, err := transport.HTTPWrappersForConfig(transportConfig, tlsRoundTripper)
+	_transport, err := transport.HTTPWrappersForConfig(kcm.transportConfig, tlsRoundTripper)
 	if err != nil {
+		tlsRoundTripper.Conn.Close()
 		logger.Debug("cannot create transport: ", err)
 		return nil, nil, err
 	}
 	client := http.Client{Transport: _transport}
 	conn := tlsRoundTripper.Conn
-	utils.RedirectRequest(r, kcm.target)
-	logger.Trace("sending redirected request to api server: ", r.URL.String())
+	logger.Trace("sending redirected upgrade request to api server: ", r.URL.String())
 	resp, err := client.Do(r)
 	if err != nil {
 		conn.Close()
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/metrics"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/requestinfo"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
+)
+
+// newTestManager proxies to an api server answering every request, at the path prefix of the target.
+func newTestManager(tb testing.TB, prefix string) *KubernetesClientManager {
+	tb.Helper()
+	apiserver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"kind":"NodeList","apiVersion":"v1","items":[]}`))
+	}))
+	tb.Cleanup(apiserver.Close)
+	target, _ := url.Parse(apiserver.URL + prefix)
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	config := &rest.Config{Host: apiserver.URL, BearerToken: "token", TLSClientConfig: rest.TLSClientConfig{Insecure: true}}
+	kcm, err := NewKubernetesClientManager(context.Background(), logger, config, target)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return kcm
+}
+
+func newBenchmarkRequest() *http.Request {
+	r, _ := http.NewRequest(http.MethodGet, "/api/v1/nodes", nil)
+	return r
+}
+
+// BenchmarkDoSharedTransport sends requests through the keep-alive transport shared by all sessions.
+func BenchmarkDoSharedTransport(b *testing.B) {
+	kcm := newTestManager(b, "")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := newBenchmarkRequest()
+		_, resp, err := kcm.Do(uint16(i), r, requestinfo.New(r))
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// BenchmarkDoPerRequestTLS sends requests the way Do did before the transport was shared: the transport config is
+// built and a TLS connection is dialed for every request.
+func BenchmarkDoPerRequestTLS(b *testing.B) {
+	kcm := newTestManager(b, "")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := newBenchmarkRequest()
+		transportConfig, err := kcm.config.TransportConfig()
+		if err != nil {
+			b.Fatal(err)
+		}
+		tlsConfig, err := transport.TLSConfigFor(transportConfig)
+		if err != nil {
+			b.Fatal(err)
+		}
+		tlsRoundTripper, err := NewTLSRoundTripper(r.Context(), tlsConfig, kcm.target.Host)
+		if err != nil {
+			b.Fatal(err)
+		}
+		roundTripper, err := transport.HTTPWrappersForConfig(transportConfig, tlsRoundTripper)
+		if err != nil {
+			b.Fatal(err)
+		}
+		client := http.Client{Transport: roundTripper}
+		utils.RedirectRequest(r, kcm.target)
+		resp, err := client.Do(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		tlsRoundTripper.Conn.Close()
+	}
+}
+
+func requestCount(t *testing.T, verb, code string) uint64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := metrics.APIServerRequestDuration.WithLabelValues(verb, code).(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+// The verb is taken from the path sent by the stub, not from the path redirected to the target.
+func TestDoObservesVerb(t *testing.T) {
+	kcm := newTestManager(t, "/prefix")
+	for _, test := range []struct {
+		method, url, verb string
+	}{
+		{http.MethodGet, "/api/v1/pods", "list"},
+		{http.MethodGet, "/api/v1/namespaces/default/pods/web", "get"},
+		{http.MethodGet, "/apis/apps/v1/namespaces/default/deployments?watch=true", "watch"},
+		{http.MethodPost, "/apis/apps/v1/namespaces/default/deployments", "create"},
+		{http.MethodDelete, "/api/v1/namespaces/default/pods", "deletecollection"},
+		{http.MethodGet, "/healthz", "get"},
+	} {
+		r, _ := http.NewRequest(test.method, test.url, nil)
+		before := requestCount(t, test.verb, "200")
+		_, resp, err := kcm.Do(0, r, requestinfo.New(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if after := requestCount(t, test.verb, "200"); after != before+1 {
+			t.Errorf("%s %s: not observed with verb %s", test.method, test.url, test.verb)
+		}
+	}
+}
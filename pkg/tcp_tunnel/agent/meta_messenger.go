@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	errorsv1 "errors"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/utils"
 	"github.com/alibaba/alibabacloud-ack-connector/pkg/vars"
 	"io"
 	"io/ioutil"
@@ -34,6 +35,7 @@ func getAgentMeta(logger *logrus.Logger) base.AgentMeta {
 		logger.Errorf("Failed to init incluster client with error: %v", err)
 		return agentMeta
 	}
+	cfg.Proxy = utils.NoProxy
 	client, err := kubernetes.NewForConfig(cfg)
 	if err != nil {
 		logger.Errorf("Failed to init incluster client with error: %v", err)
@@ -42,7 +44,7 @@ func getAgentMeta(logger *logrus.Logger) base.AgentMeta {
 
 	k8sVersion, err := getK8sVersion(client)
 	if err != nil {
-		logger.Errorf("failed to get cluster version: ", err)
+		logger.Errorf("failed to get cluster version: %v", err)
 		return agentMeta
 	}
 
@@ -72,40 +74,57 @@ func getAgentMeta(logger *logrus.Logger) base.AgentMeta {
 	return agentMeta
 }
 
-func MetaMessenger(ctx context.Context, logger *logrus.Logger, metaConn net.Conn) error {
+// MetaMessenger syncs the agent meta with the stub every 3 seconds until the connection fails or ctx is done. Once
+// draining is closed the stub is told right away that the agent is draining.
+func MetaMessenger(ctx context.Context, logger *logrus.Logger, metaConn net.Conn, draining <-chan struct{}) error {
 	var num = 0
+	var state string
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
+		case <-draining:
+			state = base.AgentStateDraining
+			draining = nil
 		default:
-			logger.Trace("syncing meta")
-			var agentMeta base.AgentMeta
+		}
+		logger.Trace("syncing meta")
+		var agentMeta base.AgentMeta
 
-			if num%20 == 0 {
-				agentMeta = getAgentMeta(logger)
-			}
-			if bs, err := json.Marshal(&agentMeta); err != nil {
-				logger.Errorf("json marshal failed: %s, will retry after one minute", err)
-			} else {
-				metaConn.SetWriteDeadline(time.Now().Add(3 * time.Second))
-				_, err = metaConn.Write(bs)
-				if err != nil {
-					return err
-				}
+		if num%20 == 0 {
+			agentMeta = getAgentMeta(logger)
+		}
+		if state != "" {
+			if agentMeta.Data == nil {
+				agentMeta.Data = map[string]string{}
 			}
-			var ack = make([]byte, 3)
-			metaConn.SetReadDeadline(time.Now().Add(3 * time.Second))
-			_, err := io.ReadFull(metaConn, ack)
+			agentMeta.Data[base.AgentMetaStateKey] = state
+		}
+		if bs, err := json.Marshal(&agentMeta); err != nil {
+			logger.Errorf("json marshal failed: %s, will retry after one minute", err)
+		} else {
+			metaConn.SetWriteDeadline(time.Now().Add(3 * time.Second))
+			_, err = metaConn.Write(bs)
 			if err != nil {
 				return err
 			}
-			if string(ack) != "ack" {
-				logger.Warn("returned message not ack but %s", string(ack))
-			}
+		}
+		var ack = make([]byte, 3)
+		metaConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err := io.ReadFull(metaConn, ack)
+		if err != nil {
+			return err
+		}
+		if string(ack) != "ack" {
+			logger.Warnf("returned message not ack but %s", string(ack))
 		}
 		num = (num + 1) % 20
-		time.Sleep(3 * time.Second)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-draining:
+		case <-time.After(3 * time.Second):
+		}
 	}
 }
 
@@ -0,0 +1,182 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// DialTimeout bounds dialing the stub including the proxy negotiation and the TLS handshake.
+const DialTimeout = 30 * time.Second
+
+// ProxyDialer dials TLS connections to the stub, through an egress proxy when one is configured for the stub address.
+// TLS is tunnelled through HTTP and HTTPS proxies with CONNECT and through SOCKS5 proxies, the credentials are taken
+// from the userinfo of the proxy URL.
+type ProxyDialer struct {
+	// Proxy returns the proxy to dial addr through, or nil to dial it directly.
+	Proxy   func(addr string) (*url.URL, error)
+	Timeout time.Duration
+}
+
+func NewProxyDialer() *ProxyDialer {
+	return &ProxyDialer{
+		Proxy:   ProxyFromEnvironment(),
+		Timeout: DialTimeout,
+	}
+}
+
+// ProxyFromEnvironment picks the proxy from HTTPS_PROXY, or ALL_PROXY if it is not set, unless the address matches
+// NO_PROXY. Lowercase variants are accepted as well. Like net/http, localhost and loopback addresses are never
+// proxied.
+func ProxyFromEnvironment() func(addr string) (*url.URL, error) {
+	config := httpproxy.FromEnvironment()
+	if config.HTTPSProxy == "" {
+		config.HTTPSProxy = getEnvAny("ALL_PROXY", "all_proxy")
+	}
+	proxyFunc := config.ProxyFunc()
+	return func(addr string) (*url.URL, error) {
+		return proxyFunc(&url.URL{Scheme: "https", Host: addr})
+	}
+}
+
+func getEnvAny(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// DialTLS dials addr and completes the TLS handshake with config. The ServerName defaults to the host of addr.
+func (d *ProxyDialer) DialTLS(ctx context.Context, addr string, config *tls.Config) (net.Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	var proxyURL *url.URL
+	if d.Proxy != nil {
+		var err error
+		if proxyURL, err = d.Proxy(addr); err != nil {
+			return nil, fmt.Errorf("invalid proxy configuration: %s", err)
+		}
+	}
+	if proxyURL == nil {
+		dialer := &tls.Dialer{NetDialer: &net.Dialer{}, Config: config}
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	conn, err := d.dialProxy(ctx, proxyURL, addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialProxy returns a connection to addr tunnelled through the proxy.
+func (d *ProxyDialer) dialProxy(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return d.dialConnect(ctx, proxyURL, addr)
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", proxyAddr(proxyURL), auth, &net.Dialer{})
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("proxy %s: %s", proxyURL.Redacted(), err)
+		}
+		return conn, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+}
+
+// dialConnect asks a HTTP proxy to open a tunnel to addr with the CONNECT method.
+func (d *ProxyDialer) dialConnect(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr(proxyURL))
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err = request.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %s", proxyURL.Redacted(), err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %s", proxyURL.Redacted(), err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: CONNECT %s: %s", proxyURL.Redacted(), addr, response.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &base.BufferedConn{Reader: reader, Conn: conn}, nil
+}
+
+// proxyAddr returns the host and port of the proxy, the port defaults to the well known port of its scheme.
+func proxyAddr(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+	switch proxyURL.Scheme {
+	case "https":
+		return net.JoinHostPort(proxyURL.Hostname(), "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(proxyURL.Hostname(), "1080")
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), "80")
+}
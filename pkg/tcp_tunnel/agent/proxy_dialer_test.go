@@ -0,0 +1,231 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/stub"
+	"github.com/sirupsen/logrus"
+)
+
+// newTargetServer runs the TLS server standing in for the stub.
+func newTargetServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "stub")
+	}))
+	t.Cleanup(target.Close)
+	return target
+}
+
+// newConnectProxy runs the CONNECT proxy of the stub and counts the connections tunnelled through it.
+func newConnectProxy(t *testing.T, auth string) (*url.URL, *int32) {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	handler := stub.NewServer(ctx, logger, nil).ProxyHandler(auth)
+	var tunnelled int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&tunnelled, 1)
+		handler(rw, req)
+	}))
+	t.Cleanup(proxy.Close)
+	proxyURL, _ := url.Parse(proxy.URL)
+	return proxyURL, &tunnelled
+}
+
+// dialThrough dials the target with the proxy and sends a request over the connection.
+func dialThrough(proxyURL *url.URL, addr string) error {
+	dialer := &ProxyDialer{
+		Proxy:   func(string) (*url.URL, error) { return proxyURL, nil },
+		Timeout: DialTimeout,
+	}
+	conn, err := dialer.DialTLS(context.Background(), addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	request, _ := http.NewRequest(http.MethodGet, "https://"+addr+"/", nil)
+	if err = request.Write(conn); err != nil {
+		return err
+	}
+	response, err := http.ReadResponse(bufio.NewReader(conn), request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if string(body) != "stub" {
+		return fmt.Errorf("got %q from the target", body)
+	}
+	return nil
+}
+
+func TestProxyDialerConnect(t *testing.T) {
+	target := newTargetServer(t)
+	proxyURL, tunnelled := newConnectProxy(t, "user:secret")
+
+	proxyURL.User = url.UserPassword("user", "secret")
+	if err := dialThrough(proxyURL, target.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(tunnelled) != 1 {
+		t.Fatalf("%d connections went through the proxy, want 1", atomic.LoadInt32(tunnelled))
+	}
+
+	proxyURL.User = url.UserPassword("user", "wrong")
+	err := dialThrough(proxyURL, target.Listener.Addr().String())
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("got error %v, want 407 Proxy Authentication Required", err)
+	}
+	if strings.Contains(err.Error(), "wrong") {
+		t.Fatalf("error %q leaks the proxy password", err)
+	}
+}
+
+// serveSOCKS5 runs a SOCKS5 proxy which only accepts username and password authentication with user and password,
+// see RFC 1928 and RFC 1929.
+func serveSOCKS5(t *testing.T, user, password string) *url.URL {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleSOCKS5(conn, user, password)
+		}
+	}()
+	return &url.URL{Scheme: "socks5", Host: listener.Addr().String()}
+}
+
+func handleSOCKS5(conn net.Conn, user, password string) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	readBytes := func(n int) []byte {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil
+		}
+		return buf
+	}
+	readString := func() string {
+		length := readBytes(1)
+		if length == nil {
+			return ""
+		}
+		return string(readBytes(int(length[0])))
+	}
+
+	header := readBytes(2)
+	if header == nil || header[0] != 5 || !strings.Contains(string(readBytes(int(header[1]))), "\x02") {
+		conn.Write([]byte{5, 0xFF})
+		return
+	}
+	conn.Write([]byte{5, 2})
+	if version := readBytes(1); version == nil || version[0] != 1 {
+		return
+	}
+	if readString() != user || readString() != password {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	request := readBytes(4)
+	if request == nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		host = net.IP(readBytes(4)).String()
+	case 3:
+		host = readString()
+	case 4:
+		host = net.IP(readBytes(16)).String()
+	}
+	port := readBytes(2)
+	if port == nil {
+		return
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(binary.BigEndian.Uint16(port))))
+	if err != nil {
+		conn.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(target, reader)
+	io.Copy(conn, target)
+}
+
+func TestProxyDialerSOCKS5(t *testing.T) {
+	target := newTargetServer(t)
+	proxyURL := serveSOCKS5(t, "user", "secret")
+
+	proxyURL.User = url.UserPassword("user", "secret")
+	if err := dialThrough(proxyURL, target.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	proxyURL.User = url.UserPassword("user", "wrong")
+	if err := dialThrough(proxyURL, target.Listener.Addr().String()); err == nil {
+		t.Fatal("dial with a wrong password succeeded")
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy", "NO_PROXY", "no_proxy", "REQUEST_METHOD"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("HTTPS_PROXY", "http://proxy.example.com:3128")
+	t.Setenv("NO_PROXY", "stub.example.com,.corp.example.com,10.0.0.0/8")
+	proxyFunc := ProxyFromEnvironment()
+	for _, test := range []struct {
+		addr    string
+		proxied bool
+	}{
+		{"stub.example.com:443", false},
+		{"other.example.com:443", true},
+		{"stub.corp.example.com:443", false},
+		{"corp.example.com.evil:443", true},
+		{"10.1.2.3:443", false},
+		{"11.1.2.3:443", true},
+		{"127.0.0.1:443", false},
+	} {
+		proxyURL, err := proxyFunc(test.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proxied := proxyURL != nil; proxied != test.proxied {
+			t.Errorf("%s: got proxy %v, want proxied %t", test.addr, proxyURL, test.proxied)
+		}
+	}
+
+	t.Setenv("HTTPS_PROXY", "")
+	t.Setenv("ALL_PROXY", "socks5://proxy.example.com")
+	proxyURL, err := ProxyFromEnvironment()("other.example.com:443")
+	if err != nil || proxyURL == nil || proxyURL.Scheme != "socks5" {
+		t.Fatalf("got proxy %v and error %v, want the ALL_PROXY fallback", proxyURL, err)
+	}
+}
@@ -3,17 +3,29 @@ package agent
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"net/url"
+	"sync/atomic"
 	"time"
 
 	"github.com/alibaba/alibabacloud-ack-connector/pkg/id"
 
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/clockskew"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/metrics"
 	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tracing"
 	"github.com/cenkalti/backoff/v4"
+	"github.com/hashicorp/yamux"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/websocket"
 )
 
 const (
@@ -22,40 +34,105 @@ const (
 	NonSessionBackoffRandomizationFactor = 0.05
 	NonSessionBackoffMaxInterval         = 10 * time.Second
 	NonSessionBackoffMaxElapsedTime      = 0
+
+	// MuxNegotiationTimeout is how long to wait for the stub to accept a multiplexed tunnel.
+	MuxNegotiationTimeout = 5 * time.Second
+
+	// TransportFallbackAttempts is how many dials in a row have to fail before base.TransportAuto switches to the
+	// other transport.
+	TransportFallbackAttempts = 3
+
+	// stubSource names the stub in clock skew reports.
+	stubSource = "the stub"
 )
 
+// ErrMuxNotSupported is returned by ConnectMux when the stub refuses multiplexed tunnels, or closes the connection
+// without answering like stubs predating them.
+var ErrMuxNotSupported = errors.New("stub does not support multiplexed tunnels")
+
 // StubConnector construct new connection to stub server
 type StubConnector struct {
 	base.Component
 	urlStr    string
 	tlsConfig *tls.Config
 	clusterID id.ID
+	dialer    *ProxyDialer
+	// transport is one of base.TransportTLS, base.TransportWebsocket and base.TransportAuto.
+	transport    string
+	websocketURL *url.URL
+	// websocket is 1 while base.TransportAuto uses the websocket transport, failures counts the dials failed in a
+	// row with the current transport.
+	websocket int32
+	failures  int32
+	// RootCAs returns the CA the stub is verified against on each dial, it replaces the RootCAs of the TLS config if
+	// set, so a renewed CA applies to new connections.
+	RootCAs func() *x509.CertPool
 }
 
-func NewStubConnector(ctx context.Context, logger *logrus.Logger, urlStr string, tlsConfig *tls.Config) StubConnector {
-	bytes, err := ioutil.ReadFile("/run/secrets/kubernetes.io/serviceaccount/token")
+// ServiceAccountTokenPath is the token of the agent service account, the cluster ID sent to the stub is derived
+// from it.
+var ServiceAccountTokenPath = "/run/secrets/kubernetes.io/serviceaccount/token"
+
+// NewStubConnector creates a connector dialing the stub at urlStr with the given transport. websocketURL defaults to
+// wss://<host of urlStr>/tunnel.
+func NewStubConnector(ctx context.Context, logger *logrus.Logger, urlStr string, tlsConfig *tls.Config, transport, websocketURL string) (*StubConnector, error) {
+	bytes, err := ioutil.ReadFile(ServiceAccountTokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot recognize running cluster: %s", err)
+	}
+	if transport == "" {
+		transport = base.TransportTLS
+	}
+	if websocketURL == "" {
+		host, _, err := net.SplitHostPort(urlStr)
+		if err != nil {
+			return nil, err
+		}
+		websocketURL = "wss://" + host + base.WebsocketPath
+	}
+	wsURL, err := url.Parse(websocketURL)
 	if err != nil {
-		logger.Fatal("cannot recognize running cluster: ", err)
+		return nil, fmt.Errorf("invalid websocket url: %s", err)
+	}
+	if wsURL.Scheme != "wss" {
+		return nil, fmt.Errorf("invalid websocket url %s: only wss is supported", websocketURL)
+	}
+	sc := &StubConnector{
+		Component:    base.NewComponent(ctx, logger),
+		urlStr:       urlStr,
+		tlsConfig:    tlsConfig,
+		clusterID:    id.NewID(bytes),
+		dialer:       NewProxyDialer(),
+		transport:    transport,
+		websocketURL: wsURL,
 	}
-	return StubConnector{
-		Component: base.NewComponent(ctx, logger),
-		urlStr:    urlStr,
-		tlsConfig: tlsConfig,
-		clusterID: id.NewID(bytes),
+	if transport == base.TransportWebsocket {
+		sc.websocket = 1
 	}
+	return sc, nil
 }
 
 // isSession = 0 means this is the connection of request channel (first registration channel)
+// isSession = 3 means this is a request channel which multiplexes sessions, see ConnectMux
 // isSession = 1 means this is a new connection for some http request
 // sessionID should be 0 is isSession = 0, otherwise it represents the current session id received from request channel
 func (sc *StubConnector) Connect(isSession byte, sessionID uint16) (conn net.Conn, err error) {
+	return sc.ConnectContext(sc.Context, isSession, sessionID)
+}
+
+// ConnectContext is Connect giving up when ctx is done, and tracing the dial as part of the trace of ctx.
+func (sc *StubConnector) ConnectContext(ctx context.Context, isSession byte, sessionID uint16) (conn net.Conn, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "stub.connect", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("tunnel.connection_type", connTypeName(isSession)),
+		attribute.Int(tracing.SessionIDKey, int(sessionID)),
+	))
+	defer func() { tracing.EndSpan(span, err) }()
 	logger := sc.Logger
 	if isSession == 1 {
 		logger = sc.Logger.WithField(base.SessionIDHeaderKey, sessionID).Logger
 	}
-	logger.Tracef("dialing %s", sc.urlStr)
 	backoffConfig := backoff.NewExponentialBackOff()
-	if isSession == 0 {
+	if isSession == base.ConnTypeTunnel || isSession == base.ConnTypeMuxTunnel {
 		backoffConfig.InitialInterval = NonSessionBackoffInitialInterval
 		backoffConfig.Multiplier = NonSessionBackoffMultiplier
 		backoffConfig.RandomizationFactor = NonSessionBackoffRandomizationFactor
@@ -64,22 +141,200 @@ func (sc *StubConnector) Connect(isSession byte, sessionID uint16) (conn net.Con
 		backoffConfig.Reset()
 	}
 	//backoffObj := backoff.WithMaxRetries(backoffConfig, 3)
-	if err = backoff.Retry(func() error {
+	connType := connTypeName(isSession)
+	attempts := 0
+	if err = backoff.RetryNotify(func() error {
 		var e error
-		conn, e = tls.DialWithDialer(&net.Dialer{KeepAlive: 0, Timeout: 30 * time.Second}, "tcp", sc.urlStr, sc.tlsConfig)
+		attempts++
+		span.SetAttributes(attribute.Int("tunnel.dial_attempts", attempts))
+		metrics.StubConnectAttempts.WithLabelValues(connType).Inc()
+		conn, e = sc.dial(logger)
+		if e != nil {
+			metrics.StubConnectFailures.WithLabelValues(connType).Inc()
+		}
 		return e
-	}, backoffConfig); err != nil {
+	}, backoff.WithContext(backoffConfig, ctx), func(err error, wait time.Duration) {
+		var verifyErr *tls.CertificateVerificationError
+		if errors.As(err, &verifyErr) {
+			if clockskew.Default.ObserveVerifyError(stubSource, err) {
+				logger.Errorf("stub certificate rejected: %s, retry after %s", clockskew.Default.Check(), wait)
+				return
+			}
+			logger.Errorf("stub certificate rejected: %s, retry after %s", err, wait)
+			return
+		}
+		logger.Debugf("dialing failed: %s, retry after %s", err, wait)
+	}); err != nil {
 		logger.Errorf("dialing error %v", err)
 		return nil, err
 	}
+	clockskew.Default.Clear(stubSource)
 	logger.Trace("try to handshake")
+	if err = sc.handshake(conn, logger, isSession, sessionID); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connTypeName is the type label of the connect metrics.
+func connTypeName(connType byte) string {
+	switch connType {
+	case base.ConnTypeTunnel:
+		return "tunnel"
+	case base.ConnTypeSession:
+		return "session"
+	case base.ConnTypeMeta:
+		return "meta"
+	case base.ConnTypeMuxTunnel:
+		return "mux_tunnel"
+	}
+	return "unknown"
+}
+
+// ConnectMux registers a tunnel which multiplexes all sessions as yamux streams over a single connection. The stub
+// opens a stream for each request, so no session connection needs to be dialed. ErrMuxNotSupported is returned when
+// the stub refuses the multiplexed tunnel, the caller should fall back to Connect then. Any other failure of the
+// negotiation is returned as an error of the tunnel.
+func (sc *StubConnector) ConnectMux() (*yamux.Session, error) {
+	conn, err := sc.Connect(base.ConnTypeMuxTunnel, 0)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(MuxNegotiationTimeout))
+	if err = readMuxAnswer(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	config := yamux.DefaultConfig()
+	config.LogOutput = ioutil.Discard
+	session, err := yamux.Client(conn, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sc.Logger.Info("multiplexed tunnel established")
+	return session, nil
+}
+
+// readMuxAnswer reads the answer of the stub to ConnTypeMuxTunnel, nil if it is base.MuxAccepted.
+func readMuxAnswer(conn net.Conn) error {
+	answer := make([]byte, len(base.MuxAccepted))
+	if _, err := io.ReadFull(conn, answer[:1]); err != nil {
+		if err == io.EOF {
+			return ErrMuxNotSupported
+		}
+		return fmt.Errorf("read multiplexed tunnel answer: %s", err)
+	}
+	if answer[0] != base.MuxAccepted[0] {
+		return fmt.Errorf("unexpected answer %q to multiplexed tunnel", answer[:1])
+	}
+	if _, err := io.ReadFull(conn, answer[1:]); err != nil {
+		return fmt.Errorf("read multiplexed tunnel answer: %s", err)
+	}
+	switch string(answer) {
+	case base.MuxAccepted:
+		return nil
+	case base.MuxRefused:
+		return ErrMuxNotSupported
+	}
+	return fmt.Errorf("unexpected answer %q to multiplexed tunnel", answer)
+}
+
+// dial connects to the stub with the current transport. With base.TransportAuto the transport is switched after
+// TransportFallbackAttempts failed dials in a row.
+func (sc *StubConnector) dial(logger *logrus.Logger) (net.Conn, error) {
+	useWebsocket := atomic.LoadInt32(&sc.websocket) == 1
+	addr := sc.urlStr
+	if useWebsocket {
+		addr = sc.websocketURL.String()
+	}
+	if proxyURL, err := sc.dialer.Proxy(sc.dialAddr(useWebsocket)); err == nil && proxyURL != nil {
+		logger.Tracef("dialing %s through proxy %s", addr, proxyURL.Redacted())
+	} else {
+		logger.Tracef("dialing %s", addr)
+	}
+
+	var conn net.Conn
+	var err error
+	if useWebsocket {
+		conn, err = sc.dialWebsocket()
+	} else {
+		conn, err = sc.dialer.DialTLS(sc.Context, sc.urlStr, sc.newTLSConfig())
+	}
+	if sc.transport != base.TransportAuto {
+		return conn, err
+	}
+	if err == nil {
+		atomic.StoreInt32(&sc.failures, 0)
+		return conn, nil
+	}
+	if atomic.AddInt32(&sc.failures, 1) >= TransportFallbackAttempts {
+		next := int32(1)
+		if useWebsocket {
+			next = 0
+		}
+		if atomic.CompareAndSwapInt32(&sc.websocket, 1-next, next) {
+			atomic.StoreInt32(&sc.failures, 0)
+			sc.Logger.Warnf("dialing %s failed %d times, switch transport", addr, TransportFallbackAttempts)
+		}
+	}
+	return nil, err
+}
+
+// dialAddr returns the host and port dialed by the transport.
+func (sc *StubConnector) dialAddr(useWebsocket bool) string {
+	if !useWebsocket {
+		return sc.urlStr
+	}
+	if sc.websocketURL.Port() != "" {
+		return sc.websocketURL.Host
+	}
+	return net.JoinHostPort(sc.websocketURL.Hostname(), "443")
+}
+
+// newTLSConfig returns the TLS config of a new connection to the stub.
+func (sc *StubConnector) newTLSConfig() *tls.Config {
+	tlsConfig := sc.tlsConfig.Clone()
+	if sc.RootCAs != nil {
+		tlsConfig.RootCAs = sc.RootCAs()
+	}
+	return tlsConfig
+}
+
+// dialWebsocket opens a websocket to the stub, the tunnel protocol is carried as binary messages, see
+// base.WebsocketConn.
+func (sc *StubConnector) dialWebsocket() (net.Conn, error) {
+	tlsConfig := sc.newTLSConfig()
+	tlsConfig.ServerName = sc.websocketURL.Hostname()
+	conn, err := sc.dialer.DialTLS(sc.Context, sc.dialAddr(true), tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	config, err := websocket.NewConfig(sc.websocketURL.String(), "https://"+sc.websocketURL.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	config.TlsConfig = tlsConfig
+	conn.SetDeadline(time.Now().Add(DialTimeout))
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake with %s failed: %s", sc.websocketURL, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return base.NewWebsocketConn(ws), nil
+}
+
+func (sc *StubConnector) handshake(conn net.Conn, logger *logrus.Logger, isSession byte, sessionID uint16) error {
 	bs := []byte{isSession, 0, 0}
 	binary.BigEndian.PutUint16(bs[1:3], sessionID)
 	if n, err := conn.Write(bs); err != nil || n != 3 {
 		conn.Close()
 		err = fmt.Errorf("handshake failed <%d>: %s", n, err)
 		logger.Trace(err)
-		return nil, err
+		return err
 	}
 	if isSession == 1 {
 		logger.Trace("connected")
@@ -89,9 +344,9 @@ func (sc *StubConnector) Connect(isSession byte, sessionID uint16) (conn net.Con
 			conn.Close()
 			err = fmt.Errorf("send cluster id failed <%d>: %s", n, err)
 			logger.Info(err)
-			return nil, err
+			return err
 		}
 		logger.Info("connected")
 	}
-	return conn, nil
+	return nil
 }
@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
+)
+
+func TestReadMuxAnswer(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		answer string
+		// close closes the stub side after writing the answer
+		close bool
+		// wantErr is nil, ErrMuxNotSupported or errOther
+		wantErr error
+	}{
+		{name: "accepted", answer: base.MuxAccepted, wantErr: nil},
+		{name: "refused", answer: base.MuxRefused, close: true, wantErr: ErrMuxNotSupported},
+		{name: "closed without answer", close: true, wantErr: ErrMuxNotSupported},
+		{name: "timeout", wantErr: errOther},
+		{name: "http request", answer: "GET / HTTP/1.1\r\n\r\n", wantErr: errOther},
+		{name: "unknown answer", answer: "\x00mux-something", wantErr: errOther},
+		{name: "truncated answer", answer: base.MuxAccepted[:4], close: true, wantErr: errOther},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			agentConn, stubConn := net.Pipe()
+			defer agentConn.Close()
+			go func() {
+				if test.answer != "" {
+					stubConn.Write([]byte(test.answer))
+				}
+				if test.close {
+					stubConn.Close()
+				}
+			}()
+			defer stubConn.Close()
+			agentConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+
+			err := readMuxAnswer(agentConn)
+			switch {
+			case test.wantErr == errOther && (err == nil || err == ErrMuxNotSupported):
+				t.Fatalf("got %v, want an error of the tunnel", err)
+			case test.wantErr != errOther && err != test.wantErr:
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// errOther stands for any error but ErrMuxNotSupported in TestReadMuxAnswer.
+var errOther = errors.New("other")
@@ -2,16 +2,21 @@ package agent
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"net"
 	"net/http"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
 )
 
 // TLSRoundTripper is a roundtripper used for http client connection hijack
 // Usually, http client will automatically close connection after handling response but SPDY needs to hold that
 // connection and expose it to outer scope for later use. This roundtripper is designed to do it.
+// Conn keeps the data buffered while reading the response, and supports CloseWrite to half-close the connection.
 type TLSRoundTripper struct {
-	Conn net.Conn
+	Conn   net.Conn
+	reader *bufio.Reader
 }
 
 func (tlsRoundTripper *TLSRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
@@ -19,13 +24,19 @@ func (tlsRoundTripper *TLSRoundTripper) RoundTrip(r *http.Request) (*http.Respon
 	if err != nil {
 		return nil, err
 	}
-	return http.ReadResponse(bufio.NewReader(tlsRoundTripper.Conn), r)
+	return http.ReadResponse(tlsRoundTripper.reader, r)
 }
 
-func NewTLSRoundTripper(config *tls.Config, address string) (*TLSRoundTripper, error) {
-	conn, err := tls.Dial("tcp", address, config)
+// NewTLSRoundTripper dials address, the dial is aborted when ctx is done.
+func NewTLSRoundTripper(ctx context.Context, config *tls.Config, address string) (*TLSRoundTripper, error) {
+	dialer := &tls.Dialer{Config: config}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
 		return nil, err
 	}
-	return &TLSRoundTripper{Conn: conn}, nil
+	reader := bufio.NewReader(conn)
+	return &TLSRoundTripper{
+		Conn:   &base.BufferedConn{Reader: reader, Conn: conn},
+		reader: reader,
+	}, nil
 }
@@ -2,80 +2,177 @@ package tcp_tunnel
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
-	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/agent"
-	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
-	"github.com/sirupsen/logrus"
-	"k8s.io/client-go/rest"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"sync"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/audit"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/metrics"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/policy"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/requestinfo"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/agent"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tracing"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/utils"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/hashicorp/yamux"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
 )
 
+// AgentConfig configures the tunnels established by RunAgent.
+type AgentConfig struct {
+	// ServerAddr is the address of the stub server.
+	ServerAddr string
+	// TargetURL is the address of the kubernetes api server requests are proxied to.
+	TargetURL *url.URL
+	// RestConfig is used to authenticate against the kubernetes api server.
+	RestConfig *rest.Config
+	// TLSConfig is used to connect to the stub server.
+	TLSConfig *tls.Config
+	// RootCAs returns the current CA of the stub, it replaces TLSConfig.RootCAs on each dial if set.
+	RootCAs         func() *x509.CertPool
+	TunnelsPerAgent int
+	// Multiplex negotiates tunnels which carry all sessions as streams with the stub, and falls back to a
+	// connection per session when the stub does not support it.
+	Multiplex bool
+	// MaxSessionsPerTunnel bounds the sessions in flight on each tunnel, further requests are answered with 503.
+	MaxSessionsPerTunnel int
+	// MaxRequestBodySize bounds the request bodies read off the tunnels, larger requests are answered with 413.
+	// base.DefaultMaxRequestBodySize is used if it is 0.
+	MaxRequestBodySize int64
+	// FrameInspection pipes SPDY and websocket traffic frame by frame instead of copying raw bytes.
+	FrameInspection bool
+	// MaxFrameSize is the largest frame accepted by frame inspection, larger frames terminate the session.
+	MaxFrameSize int
+	// ShutdownGracePeriod is how long sessions in flight may run after the context of RunAgent is done.
+	ShutdownGracePeriod time.Duration
+	// Transport carries the connections to the stub, see base.TransportTLS, base.TransportWebsocket and
+	// base.TransportAuto.
+	Transport string
+	// WebsocketURL is the wss:// endpoint of the stub used by the websocket transport.
+	WebsocketURL string
+	// Auditor records every proxied request, nothing is recorded if it is nil.
+	Auditor *audit.Logger
+	// Policy is evaluated before requests are sent to the api server, denied requests are answered with 403.
+	Policy *policy.Engine
+}
+
 type AgentClient struct {
 	base.TunnelEndpoint
-	kubernetesClientManager agent.KubernetesClientManager
-	stubConnector           agent.StubConnector
+	kubernetesClientManager *agent.KubernetesClientManager
+	stubConnector           connector
+	// multiplex is 1 until the stub refuses a multiplexed tunnel, it is shared by all tunnel supervisors.
+	multiplex            int32
+	maxSessionsPerTunnel int
+	maxRequestBodySize   int64
+	// sessions holds the cancel functions of sessions in flight by tunnel and session ID, so the stub can cancel them.
+	sessionsLock sync.Mutex
+	sessions     map[sessionKey]*session
+	// draining is closed when the agent is shutting down, new sessions are rejected from then on.
+	draining chan struct{}
+	auditor  *audit.Logger
+	policy   *policy.Engine
+	// newTunnelBackoff paces the registrations of a tunnel supervisor, its backoff is reset once a tunnel served for
+	// stableTunnelPeriod.
+	newTunnelBackoff   func() backoff.BackOff
+	stableTunnelPeriod time.Duration
+}
+
+// connector dials the stub, it is implemented by agent.StubConnector.
+type connector interface {
+	Connect(isSession byte, sessionID uint16) (net.Conn, error)
+	ConnectContext(ctx context.Context, isSession byte, sessionID uint16) (net.Conn, error)
+	ConnectMux() (*yamux.Session, error)
+}
+
+// sessionKey identifies a session, the session IDs of different tunnels may collide. A tunnel is identified by its
+// session pool.
+type sessionKey struct {
+	tunnel *base.SessionPool
+	id     uint16
 }
 
-// The creation of AgentClient will block until connection is gone or context is done.
-func RunAgent(ctx context.Context, logger *logrus.Logger, urlStr string, targetURL *url.URL, cfg *rest.Config, tunnelTLSConfig *tls.Config, tunnelSPerAgent int) error {
-	ctx, cancel := context.WithCancel(ctx)
+// session is a request in flight, its context is canceled when the stub cancels it or closes its connection.
+type session struct {
+	cancel context.CancelFunc
+}
+
+// The creation of AgentClient will block until connection is gone or context is done. When the context is done the
+// agent drains: new sessions are rejected, the stub is notified and sessions in flight get ShutdownGracePeriod to
+// finish before the tunnels are closed.
+func RunAgent(ctx context.Context, logger *logrus.Logger, config *AgentConfig) error {
+	// the tunnels outlive ctx while the agent is draining
+	runCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	cfg := config.RestConfig
+	kubernetesClientManager, err := agent.NewKubernetesClientManager(runCtx, logger, cfg, config.TargetURL)
+	if err != nil {
+		return err
+	}
+	stubConnector, err := agent.NewStubConnector(runCtx, logger, config.ServerAddr, config.TLSConfig, config.Transport, config.WebsocketURL)
+	if err != nil {
+		return err
+	}
 	client := &AgentClient{
-		TunnelEndpoint:          base.NewTunnelEndpoint(ctx, logger),
-		kubernetesClientManager: agent.NewKubernetesClientManager(ctx, logger, cfg, targetURL),
-		stubConnector:           agent.NewStubConnector(ctx, logger, urlStr, tunnelTLSConfig),
+		TunnelEndpoint:          base.NewTunnelEndpoint(runCtx, logger),
+		kubernetesClientManager: kubernetesClientManager,
+		stubConnector:           stubConnector,
+		maxSessionsPerTunnel:    config.MaxSessionsPerTunnel,
+		maxRequestBodySize:      config.MaxRequestBodySize,
+		sessions:                map[sessionKey]*session{},
+		draining:                make(chan struct{}),
+		auditor:                 config.Auditor,
+		policy:                  config.Policy,
+		newTunnelBackoff:        newTunnelBackoff,
+		stableTunnelPeriod:      StableTunnelPeriod,
+	}
+	stubConnector.RootCAs = config.RootCAs
+	if config.Multiplex {
+		client.multiplex = 1
 	}
-	client.Logger.Infof("proxy to %s", targetURL)
+	if client.maxRequestBodySize <= 0 {
+		client.maxRequestBodySize = base.DefaultMaxRequestBodySize
+	}
+	client.FrameInspection = config.FrameInspection
+	client.MaxFrameSize = config.MaxFrameSize
+	client.Logger.Infof("proxy to %s", config.TargetURL)
 	client.Logger.Infof("waiting for meta connection established")
 
-	var reconnect = make(chan struct{}, 2)
-	for i := 0; i < tunnelSPerAgent; i++ {
-		conn, err := client.stubConnector.Connect(0, 0)
-		if err != nil {
-			return err
+	drained := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.drain(config.ShutdownGracePeriod)
+			close(drained)
+		case <-runCtx.Done():
 		}
-		defer conn.Close()
-
-		//logger.Infof("tunnelsPerAgent, desired: %v", tunnelSPerAgent)
-		go base.Heartbeat(ctx, logger, conn, cfg)
-		go func() {
-			var lock sync.Mutex
-			for {
-				select {
-				case <-ctx.Done():
-					logger.Info("context done")
-					return
-				default:
-					lock.Lock()
-					request, err := http.ReadRequest(bufio.NewReader(conn))
-					if err != nil {
-						lock.Unlock()
-						client.Logger.Error("read request failed: ", err)
-						// skip reconnect when read request failed from current connection
-						continue
-					}
-					sessionID, err := strconv.ParseUint(request.Header.Get(base.SessionIDHeaderKey), 10, 16)
-					if err != nil {
-						client.Logger.Error("read tunnel session id failed: ", err)
-						lock.Unlock()
-						continue
-					}
-					go client.newSession(uint16(sessionID), request, &lock)
-				}
-			}
-		}()
+	}()
+
+	var reconnect = make(chan struct{}, 2)
+	for i := 0; i < config.TunnelsPerAgent; i++ {
+		go client.superviseTunnel(i, cfg)
 	}
 
-	//the channel will be closed by gc after all goroutines were closed by context
-	// var reconnect = make(chan struct{}, 2)
 	go func() {
 		logger.Info("meta connection establishing")
-		metaConn, err := client.stubConnector.Connect(2, 0)
+		metaConn, err := client.stubConnector.Connect(base.ConnTypeMeta, 0)
 		if err != nil {
 			logger.Errorf("meta connection connect failed: %s", err)
 			reconnect <- struct{}{}
@@ -83,14 +180,15 @@ func RunAgent(ctx context.Context, logger *logrus.Logger, urlStr string, targetU
 		}
 		defer metaConn.Close()
 		logger.Info("meta connection established")
-		go base.StartHealthzServer(":10254", logger)
+		base.DefaultStatus.SetMetaUp(true)
+		defer base.DefaultStatus.SetMetaUp(false)
 		for {
 			select {
-			case <-ctx.Done():
+			case <-runCtx.Done():
 				logger.Info("meta connection exit normally")
 				return
 			default:
-				if err = agent.MetaMessenger(ctx, logger, metaConn); err != nil {
+				if err = agent.MetaMessenger(runCtx, logger, metaConn, client.draining); err != nil {
 					logger.Errorf("meta connection failed: %s", err)
 				}
 				reconnect <- struct{}{}
@@ -98,34 +196,322 @@ func RunAgent(ctx context.Context, logger *logrus.Logger, urlStr string, targetU
 			}
 		}
 	}()
-	<-reconnect
-	logger.Info("reconnect signal, try to reconnect")
+	select {
+	case <-reconnect:
+		if ctx.Err() == nil {
+			logger.Info("reconnect signal, try to reconnect")
+			return nil
+		}
+		// returning would cancel the sessions in flight before the grace period is over
+		logger.Info("meta connection lost while draining, keep waiting for sessions in flight")
+		<-drained
+		logger.Info("agent drained, close tunnels")
+	case <-drained:
+		logger.Info("agent drained, close tunnels")
+	}
 	return nil
 }
 
-func (client *AgentClient) newSession(sessionID uint16, request *http.Request, lock *sync.Mutex) {
+// drain rejects new sessions and waits until the sessions in flight are finished or gracePeriod elapsed.
+func (client *AgentClient) drain(gracePeriod time.Duration) {
+	base.DefaultStatus.SetDraining()
+	close(client.draining)
+	client.Logger.Infof("agent is draining, waiting up to %s for sessions in flight", gracePeriod)
+	deadline := time.Now().Add(gracePeriod)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for time.Now().Before(deadline) {
+		client.sessionsLock.Lock()
+		inFlight := len(client.sessions)
+		client.sessionsLock.Unlock()
+		if inFlight == 0 {
+			return
+		}
+		<-ticker.C
+	}
+	client.Logger.Warn("shutdown grace period elapsed, cancel sessions in flight")
+}
+
+// serveMux serves requests arriving as streams of a multiplexed tunnel until the tunnel is closed. The first stream
+// is opened by the agent and carries heartbeats.
+func (client *AgentClient) serveMux(ctx context.Context, session *yamux.Session, cfg *rest.Config) error {
+	defer session.Close()
+	heartbeatConn, err := session.Open()
+	if err != nil {
+		return fmt.Errorf("open heartbeat stream: %s", err)
+	}
+	go func() {
+		// the tunnel is useless when heartbeat fails or the tunnel is stopped
+		base.Heartbeat(ctx, client.Logger, heartbeatConn, cfg)
+		session.Close()
+	}()
+	pool := base.NewSessionPool(client.maxSessionsPerTunnel)
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go client.serveStream(pool, stream)
+	}
+}
+
+func (client *AgentClient) serveStream(pool *base.SessionPool, stream net.Conn) {
+	reader := bufio.NewReader(stream)
+	request, done, err := client.nextRequest(reader)
+	defer done()
+	var tooLarge *requestTooLargeError
+	if err != nil && !errors.As(err, &tooLarge) {
+		client.Logger.Error("read request failed: ", err)
+		stream.Close()
+		return
+	}
+	sessionID, parseErr := parseSessionID(request)
+	if parseErr != nil {
+		client.Logger.Error("read tunnel session id failed: ", parseErr)
+		stream.Close()
+		return
+	}
+	agentConn := &base.BufferedConn{Reader: reader, Conn: stream}
+	if tooLarge != nil {
+		client.rejectTooLarge(sessionID, request, agentConn, tooLarge.size)
+		return
+	}
+	client.dispatch(pool, sessionID, request, agentConn)
+}
+
+// requestTooLargeError is returned by readRequest along with the request if its body exceeds the limit.
+type requestTooLargeError struct {
+	// size is the size of the discarded body.
+	size int64
+}
+
+func (e *requestTooLargeError) Error() string {
+	return fmt.Sprintf("request body of %d bytes too large", e.size)
+}
+
+// readRequest reads the next request including its body off the tunnel, so the tunnel is free for the next request
+// as soon as this function returns. A body larger than maxBodySize is discarded, and the request is returned without
+// it along with a *requestTooLargeError.
+func readRequest(reader *bufio.Reader, maxBodySize int64) (*http.Request, error) {
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, maxBodySize+1))
+	if err == nil && int64(len(body)) > maxBodySize {
+		// the rest of the body is in front of the next request on the tunnel
+		var discarded int64
+		if discarded, err = io.Copy(ioutil.Discard, request.Body); err == nil {
+			request.Body.Close()
+			request.Body = http.NoBody
+			request.ContentLength = 0
+			request.TransferEncoding = nil
+			return request, &requestTooLargeError{size: int64(len(body)) + discarded}
+		}
+	}
+	request.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read request body: %s", err)
+	}
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	request.ContentLength = int64(len(body))
+	request.TransferEncoding = nil
+	return request, nil
+}
+
+func parseSessionID(request *http.Request) (uint16, error) {
+	sessionID, err := strconv.ParseUint(request.Header.Get(base.SessionIDHeaderKey), 10, 16)
+	return uint16(sessionID), err
+}
+
+// dispatch hands the session to a worker of the pool, or answers 503 when the tunnel has too many sessions in
+// flight.
+func (client *AgentClient) dispatch(pool *base.SessionPool, sessionID uint16, request *http.Request, agentConn net.Conn) {
+	ctx, cancel, ok := client.newSessionContext(pool, sessionID)
+	if !ok {
+		client.Logger.WithField(base.SessionIDHeaderKey, sessionID).Debug("agent is draining, reject request")
+		client.reject(sessionID, request, agentConn, "the agent is shutting down, please try again later")
+		return
+	}
+	if pool.TrySubmit(func() {
+		defer cancel()
+		client.newSession(ctx, cancel, sessionID, request, agentConn)
+	}) {
+		return
+	}
+	cancel()
+	client.Logger.WithField(base.SessionIDHeaderKey, sessionID).Warnf("%d sessions in flight, reject request", pool.InFlight())
+	client.reject(sessionID, request, agentConn, "too many requests in flight on the tunnel, please try again later")
+}
+
+// reject answers the request with 503 without sending it to the api server.
+func (client *AgentClient) reject(sessionID uint16, request *http.Request, agentConn net.Conn, message string) {
+	event := client.auditor.NewEvent(sessionID, request)
+	// the body was read off the tunnel already, it is discarded here so the audit event counts it
+	io.Copy(ioutil.Discard, request.Body)
+	response := utils.NewStatusResponse(request, http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable, message)
+	response.Header.Set("Retry-After", "1")
+	go client.writeResponse(sessionID, response, agentConn, event, 0)
+}
+
+// rejectTooLarge answers a request whose body of bodySize bytes exceeds maxRequestBodySize with 413.
+func (client *AgentClient) rejectTooLarge(sessionID uint16, request *http.Request, agentConn net.Conn, bodySize int64) {
+	client.Logger.WithField(base.SessionIDHeaderKey, sessionID).Warnf("request body exceeds %d bytes, reject request", client.maxRequestBodySize)
+	event := client.auditor.NewEvent(sessionID, request)
+	message := fmt.Sprintf("the request body exceeds the limit of %d bytes of the agent", client.maxRequestBodySize)
+	response := utils.NewStatusResponse(request, http.StatusRequestEntityTooLarge, metav1.StatusReasonRequestEntityTooLarge, message)
+	go client.writeResponse(sessionID, response, agentConn, event, bodySize)
+}
+
+// writeResponse writes a response which is not returned by the api server to the stub. A session connection is
+// dialed if agentConn is nil. The rejected request is recorded in the audit log with requestBytes read off the tunnel
+// besides those counted by event.
+func (client *AgentClient) writeResponse(sessionID uint16, response *http.Response, agentConn net.Conn, event *audit.Event, requestBytes int64) {
 	var err error
+	written := &metrics.CountingWriter{}
+	defer func() {
+		event.Finish(response.StatusCode, err, requestBytes, written.Written())
+		client.auditor.Log(event)
+	}()
+	if agentConn == nil {
+		if agentConn, err = client.stubConnector.Connect(base.ConnTypeSession, sessionID); err != nil {
+			client.Logger.Error("connect stub err: ", err)
+			return
+		}
+	}
+	defer agentConn.Close()
+	written.Writer = agentConn
+	if err = response.Write(written); err != nil {
+		client.Logger.Error("write HTTP response failed: ", err)
+	}
+}
+
+// newSessionContext registers a session, its context is canceled by cancelSession or by calling the returned
+// function, which must be called when the session is finished. No session is registered once the agent is draining.
+func (client *AgentClient) newSessionContext(tunnel *base.SessionPool, sessionID uint16) (context.Context, context.CancelFunc, bool) {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	select {
+	case <-client.draining:
+		return nil, nil, false
+	default:
+	}
+	ctx, cancel := context.WithCancel(client.Context)
+	s := &session{cancel: cancel}
+	key := sessionKey{tunnel: tunnel, id: sessionID}
+	client.sessions[key] = s
+	return ctx, func() {
+		cancel()
+		client.sessionsLock.Lock()
+		// a session reusing the ID may have been registered since
+		if client.sessions[key] == s {
+			delete(client.sessions, key)
+		}
+		client.sessionsLock.Unlock()
+	}, true
+}
+
+// cancelSession cancels the session in flight on the tunnel with the given ID, if any.
+func (client *AgentClient) cancelSession(tunnel *base.SessionPool, sessionID uint16) {
+	client.sessionsLock.Lock()
+	s, ok := client.sessions[sessionKey{tunnel: tunnel, id: sessionID}]
+	client.sessionsLock.Unlock()
+	if ok {
+		client.Logger.WithField(base.SessionIDHeaderKey, sessionID).Debug("session canceled by stub")
+		s.cancel()
+	}
+}
+
+// watchSessionConn cancels the session once the stub closes the session connection. The stub writes nothing to the
+// session connection of a request which is not upgraded, so any read returning means the client is gone.
+func watchSessionConn(agentConn net.Conn, cancel context.CancelFunc) {
+	var b [1]byte
+	agentConn.Read(b[:])
+	cancel()
+}
+
+// do sends the request to the api server unless the policy denies it, a denied request is answered with a 403
+// Status instead.
+func (client *AgentClient) do(sessionID uint16, request *http.Request) (net.Conn, *http.Response, error) {
+	// the request is redirected to the target by Do, so it is described with the path sent by the stub
+	info := requestinfo.New(request)
+	decision := client.policy.Evaluate(info)
+	if decision.DryRun {
+		client.Logger.WithField(base.SessionIDHeaderKey, sessionID).Warnf("dry run: %s, request forwarded", decision.Message())
+	} else if !decision.Allowed {
+		client.Logger.WithField(base.SessionIDHeaderKey, sessionID).Warn(decision.Message())
+		return nil, utils.NewStatusResponse(request, http.StatusForbidden, metav1.StatusReasonForbidden, decision.Message()), nil
+	}
+	return client.kubernetesClientManager.Do(sessionID, request, info)
+}
+
+// newSession proxies the request to the api server. The response is written to agentConn, a session connection is
+// dialed to the stub if agentConn is nil. The request to the api server is aborted as soon as ctx is done.
+// The session is traced as a span continuing the trace of the traceparent header of the request, if any, and
+// recorded in the audit log once it is finished.
+func (client *AgentClient) newSession(ctx context.Context, cancel context.CancelFunc, sessionID uint16, request *http.Request, agentConn net.Conn) {
+	var err error
+	var status int
+	var requestBytes, responseBytes int64
+	event := client.auditor.NewEvent(sessionID, request)
+	defer func() {
+		event.Finish(status, err, requestBytes, responseBytes)
+		client.auditor.Log(event)
+	}()
 
-	k8sConn, response, err := client.kubernetesClientManager.Do(sessionID, request)
-	lock.Unlock()
+	upgrade := httpstream.IsUpgradeRequest(request)
+	ctx, span := tracing.Tracer().Start(tracing.Extract(ctx, request.Header), "session", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.Int(tracing.SessionIDKey, int(sessionID)),
+		semconv.HTTPMethodKey.String(request.Method),
+		semconv.HTTPTargetKey.String(request.URL.RequestURI()),
+		attribute.Bool("http.upgrade", upgrade),
+	))
+	defer func() { tracing.EndSpan(span, err) }()
+	request = request.WithContext(ctx)
+	if agentConn != nil && !upgrade {
+		go watchSessionConn(agentConn, cancel)
+	}
+
+	k8sConn, response, err := client.do(sessionID, request)
 	if err != nil {
 		client.Logger.Error("connect session with K8s err: ", err)
+		if agentConn != nil {
+			agentConn.Close()
+		}
 		return
 	}
 
-	var agentConn net.Conn
-	if agentConn, err = client.stubConnector.Connect(1, sessionID); err != nil {
-		client.Logger.Error("connect stub err: ", err)
-		return
+	defer response.Body.Close()
+	status = response.StatusCode
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(response.StatusCode))
+	if k8sConn != nil {
+		defer k8sConn.Close()
+	}
+
+	if agentConn == nil {
+		if agentConn, err = client.stubConnector.ConnectContext(ctx, base.ConnTypeSession, sessionID); err != nil {
+			client.Logger.Error("connect stub err: ", err)
+			return
+		}
+		if !upgrade {
+			go watchSessionConn(agentConn, cancel)
+		}
 	}
 	defer agentConn.Close()
 
-	if err = response.Write(agentConn); err != nil {
+	written := &metrics.CountingWriter{Writer: agentConn}
+	err = response.Write(written)
+	responseBytes = written.Written()
+	if err != nil {
 		client.Logger.Error("write HTTP response failed: ", err)
 		return
 	}
 
 	client.Logger.Trace("HTTP response returned")
 
-	client.CheckAndStartPipe(request, response, agentConn, k8sConn)
+	requestBytes, responseBytes = client.CheckAndStartPipe(request, response, agentConn, k8sConn)
+	responseBytes += written.Written()
 }
@@ -0,0 +1,322 @@
+package tcp_tunnel_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/audit"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/agent"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/stub"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/rest"
+)
+
+// testEnv runs an api server, the reference stub and an agent connected to it.
+type testEnv struct {
+	apiserver *httptest.Server
+	stub      *stub.Server
+	// kube is the listener of the stub requests are sent to, like kubectl would.
+	kube  *httptest.Server
+	agent chan error
+	// stopAgent cancels the context of RunAgent, which makes the agent drain.
+	stopAgent context.CancelFunc
+	auditLog  string
+}
+
+// testEnvConfig selects how the agent and the stub of a testEnv talk to each other.
+type testEnvConfig struct {
+	multiplex bool
+	// stubRefusesMux makes the stub refuse multiplexed tunnels like a stub with --multiplex=false.
+	stubRefusesMux bool
+	// transport is base.TransportTLS if empty.
+	transport string
+}
+
+func (c testEnvConfig) String() string {
+	transport := c.transport
+	if transport == "" {
+		transport = base.TransportTLS
+	}
+	return fmt.Sprintf("multiplex=%t,stubRefusesMux=%t,transport=%s", c.multiplex, c.stubRefusesMux, transport)
+}
+
+func newTestEnv(t *testing.T, config testEnvConfig) *testEnv {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenPath, []byte("test-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	agent.ServiceAccountTokenPath = tokenPath
+
+	env := &testEnv{agent: make(chan error, 1), auditLog: filepath.Join(t.TempDir(), "audit.log")}
+	env.apiserver = httptest.NewTLSServer(http.HandlerFunc(serveAPI))
+	t.Cleanup(env.apiserver.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cert, _, err := stub.SelfSignedCertificate([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.stub = stub.NewServer(ctx, logger, &tls.Config{Certificates: []tls.Certificate{cert}})
+	env.stub.Multiplex = !config.stubRefusesMux
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go env.stub.Serve(listener)
+	env.kube = httptest.NewServer(env.stub.Handler())
+	t.Cleanup(env.kube.Close)
+	websocketServer := httptest.NewUnstartedServer(env.stub.WebsocketHandler())
+	websocketServer.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	websocketServer.StartTLS()
+	t.Cleanup(websocketServer.Close)
+	transport := config.transport
+	if transport == "" {
+		transport = base.TransportTLS
+	}
+
+	target, _ := url.Parse(env.apiserver.URL)
+	agentCtx, stopAgent := context.WithCancel(ctx)
+	env.stopAgent = stopAgent
+	go func() {
+		env.agent <- tcp_tunnel.RunAgent(agentCtx, logger, &tcp_tunnel.AgentConfig{
+			ServerAddr:          listener.Addr().String(),
+			TargetURL:           target,
+			RestConfig:          &rest.Config{Host: env.apiserver.URL, TLSClientConfig: rest.TLSClientConfig{Insecure: true}},
+			TLSConfig:           &tls.Config{InsecureSkipVerify: true},
+			TunnelsPerAgent:     1,
+			MaxRequestBodySize:  testMaxBodySize,
+			Auditor:             audit.NewLogger(audit.LevelMetadata, env.auditLog, 1, 1),
+			Multiplex:           config.multiplex,
+			ShutdownGracePeriod: time.Second,
+			Transport:           transport,
+			WebsocketURL:        "wss://" + websocketServer.Listener.Addr().String() + base.WebsocketPath,
+		})
+	}()
+	t.Cleanup(func() {
+		stopAgent()
+		select {
+		case <-env.agent:
+		case <-time.After(10 * time.Second):
+			t.Error("agent did not stop")
+		}
+		cancel()
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for env.stub.Meta().State != base.TunnelStateConnected {
+		if time.Now().After(deadline) {
+			t.Fatal("agent did not connect to the stub")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return env
+}
+
+const testMaxBodySize = 1024
+
+// slowStarted receives a value when a request to /slow arrives at the api server.
+var slowStarted = make(chan struct{}, 1)
+
+// serveAPI answers /hello, echoes the body of /echo and the traffic of /upgrade upper-cased until the client
+// half-closes. /slow answers after half a second.
+func serveAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/slow":
+		slowStarted <- struct{}{}
+		time.Sleep(500 * time.Millisecond)
+		io.WriteString(w, "done")
+	case "/hello":
+		fmt.Fprintf(w, "hello %s", r.Header.Get("Authorization"))
+	case "/echo":
+		io.Copy(w, r.Body)
+	case "/upgrade":
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", r.Header.Get("Upgrade"))
+		data, _ := ioutil.ReadAll(buf)
+		conn.Write(bytes.ToUpper(data))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestRunAgent(t *testing.T) {
+	for _, config := range []testEnvConfig{
+		{multiplex: false},
+		{multiplex: true},
+		{multiplex: true, stubRefusesMux: true},
+		{multiplex: false, transport: base.TransportWebsocket},
+		{multiplex: true, transport: base.TransportWebsocket},
+	} {
+		t.Run(config.String(), func(t *testing.T) {
+			env := newTestEnv(t, config)
+			t.Run("get", env.testGet)
+			t.Run("upgrade", env.testUpgrade)
+			t.Run("body", env.testBody)
+			t.Run("drain", env.testDrain)
+		})
+	}
+}
+
+func (env *testEnv) testGet(t *testing.T) {
+	resp, err := http.Get(env.kube.URL + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello " {
+		t.Fatalf("got %d %q, want 200 %q", resp.StatusCode, body, "hello ")
+	}
+}
+
+func (env *testEnv) testUpgrade(t *testing.T) {
+	conn, err := net.Dial("tcp", env.kube.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprint(conn, "GET /upgrade HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: test-protocol\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "test-protocol" {
+		t.Fatalf("got %d upgrade %q, want 101 test-protocol", resp.StatusCode, resp.Header.Get("Upgrade"))
+	}
+	if _, err = io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	// the api server answers once it reads EOF, which needs the half-close to travel through the tunnel
+	if err = conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	echo, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != "PING" {
+		t.Fatalf("got %q, want %q", echo, "PING")
+	}
+}
+
+func (env *testEnv) testBody(t *testing.T) {
+	for _, test := range []struct {
+		size int
+		code int
+	}{
+		{testMaxBodySize, http.StatusOK},
+		{testMaxBodySize + 1, http.StatusRequestEntityTooLarge},
+		// the tunnel is still in sync after the body of the rejected request has been discarded
+		{10, http.StatusOK},
+	} {
+		body := strings.Repeat("x", test.size)
+		resp, err := http.Post(env.kube.URL+"/echo", "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Fatalf("body of %d bytes: got %d, want %d", test.size, resp.StatusCode, test.code)
+		}
+		if test.code == http.StatusOK && string(echo) != body {
+			t.Fatalf("body of %d bytes: got %d bytes back", test.size, len(echo))
+		}
+		if event := env.waitAuditEvent(t, test.code); event.RequestBytes != int64(test.size) {
+			t.Fatalf("body of %d bytes: audit event records %d request bytes", test.size, event.RequestBytes)
+		}
+	}
+}
+
+// waitAuditEvent returns the last audit event of a POST to /echo answered with status. The event of a rejected
+// request is written after the response.
+func (env *testEnv) waitAuditEvent(t *testing.T, status int) audit.Event {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := ioutil.ReadFile(env.auditLog)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		for i := len(lines) - 1; i >= 0; i-- {
+			var event audit.Event
+			if json.Unmarshal([]byte(lines[i]), &event) == nil && event.Method == http.MethodPost && event.URI == "/echo" {
+				if event.Status == status {
+					return event
+				}
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no audit event of a request answered with %d", status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// testDrain stops the agent while a request is in flight, which must still be answered within the grace period.
+// It must run last as the agent does not serve afterwards.
+func (env *testEnv) testDrain(t *testing.T) {
+	type result struct {
+		code int
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(env.kube.URL + "/slow")
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		done <- result{code: resp.StatusCode, body: string(body)}
+	}()
+	<-slowStarted
+	env.stopAgent()
+	res := <-done
+	if res.err != nil || res.code != http.StatusOK || res.body != "done" {
+		t.Fatalf("got %d %q %v, want 200 %q", res.code, res.body, res.err, "done")
+	}
+	select {
+	case err := <-env.agent:
+		// put it back for the cleanup of newTestEnv
+		env.agent <- err
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not return after draining")
+	}
+	agentsMeta := env.stub.Meta().AgentsMeta
+	if len(agentsMeta) == 0 {
+		t.Error("stub was not told the agent is draining")
+	}
+	for cluster, agentMeta := range agentsMeta {
+		if state := agentMeta.Data[base.AgentMetaStateKey]; state != base.AgentStateDraining {
+			t.Errorf("stub sees agent %s as %q, want %q", cluster, state, base.AgentStateDraining)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/clockskew"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/healthz"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultAdminAddr = ":10254"
+	// DefaultLivenessTimeout is how long the agent loop may take to read a request off a tunnel and hand it over to
+	// its session before /livez fails.
+	DefaultLivenessTimeout = 30 * time.Second
+)
+
+// AgentStatus tracks the state of the agent reported by the admin server.
+type AgentStatus struct {
+	// LivenessTimeout is DefaultLivenessTimeout unless changed before the admin server is started.
+	LivenessTimeout time.Duration
+
+	tunnelsUp int32
+	metaUp    int32
+	draining  int32
+	// busy holds when the agent loops started to read the requests they are handling right now.
+	busyLock sync.Mutex
+	busy     map[uint64]time.Time
+	nextBusy uint64
+	// clusterErr holds the error of the last cluster check, or nil if it passed.
+	clusterErr atomic.Value
+}
+
+type clusterCheckResult struct {
+	err error
+}
+
+// DefaultStatus is the status of the agent of this process.
+var DefaultStatus = NewAgentStatus()
+
+func NewAgentStatus() *AgentStatus {
+	s := &AgentStatus{LivenessTimeout: DefaultLivenessTimeout, busy: map[uint64]time.Time{}}
+	s.clusterErr.Store(clusterCheckResult{err: errors.New("cluster not checked yet")})
+	return s
+}
+
+// TunnelUp records a tunnel registered with the stub, the returned function records it is gone.
+func (s *AgentStatus) TunnelUp() func() {
+	atomic.AddInt32(&s.tunnelsUp, 1)
+	metrics.TunnelsUp.Inc()
+	return func() {
+		atomic.AddInt32(&s.tunnelsUp, -1)
+		metrics.TunnelsUp.Dec()
+	}
+}
+
+func (s *AgentStatus) SetMetaUp(up bool) {
+	var value int32
+	if up {
+		value = 1
+	}
+	atomic.StoreInt32(&s.metaUp, value)
+}
+
+func (s *AgentStatus) SetDraining() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+// SetClusterHealth records the result of the last cluster check of the heartbeat.
+func (s *AgentStatus) SetClusterHealth(err error) {
+	s.clusterErr.Store(clusterCheckResult{err: err})
+	if err != nil {
+		metrics.HeartbeatClusterHealthy.Set(0)
+	} else {
+		metrics.HeartbeatClusterHealthy.Set(1)
+	}
+}
+
+// Busy records that an agent loop started to read a request off a tunnel, the returned function records that the
+// request is handed over to its session.
+func (s *AgentStatus) Busy() func() {
+	s.busyLock.Lock()
+	defer s.busyLock.Unlock()
+	id := s.nextBusy
+	s.nextBusy++
+	s.busy[id] = time.Now()
+	return func() {
+		s.busyLock.Lock()
+		delete(s.busy, id)
+		s.busyLock.Unlock()
+	}
+}
+
+// busyFor returns how long the agent loop has been handling the oldest request it did not hand over yet.
+func (s *AgentStatus) busyFor() time.Duration {
+	s.busyLock.Lock()
+	defer s.busyLock.Unlock()
+	var longest time.Duration
+	for _, since := range s.busy {
+		if d := time.Since(since); d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
+
+// LivezChecks fail when an agent loop is wedged, i.e. it does not read a request it started to read off a tunnel and
+// hand it over to its session within LivenessTimeout. Waiting for the next request never fails, neither does
+// bootstrapping the certificate before the loop is started.
+func (s *AgentStatus) LivezChecks() []healthz.HealthChecker {
+	return []healthz.HealthChecker{
+		healthz.PingHealthz,
+		healthz.NamedCheck("agent-loop", func(*http.Request) error {
+			if busy := s.busyFor(); busy > s.LivenessTimeout {
+				return fmt.Errorf("agent loop is stuck on a request for %s", busy.Round(time.Second))
+			}
+			return nil
+		}),
+	}
+}
+
+// ReadyzChecks fail unless the agent is able to serve requests of the stub.
+func (s *AgentStatus) ReadyzChecks() []healthz.HealthChecker {
+	return []healthz.HealthChecker{
+		healthz.NamedCheck("shutdown", func(*http.Request) error {
+			if atomic.LoadInt32(&s.draining) == 1 {
+				return errors.New("agent is draining")
+			}
+			return nil
+		}),
+		healthz.NamedCheck("tunnel", func(*http.Request) error {
+			if atomic.LoadInt32(&s.tunnelsUp) == 0 {
+				return errors.New("no tunnel registered with the stub")
+			}
+			return nil
+		}),
+		healthz.NamedCheck("meta", func(*http.Request) error {
+			if atomic.LoadInt32(&s.metaUp) == 0 {
+				return errors.New("meta connection is down")
+			}
+			return nil
+		}),
+		healthz.NamedCheck("cluster", func(*http.Request) error {
+			return s.clusterErr.Load().(clusterCheckResult).err
+		}),
+		healthz.NamedCheck("clock-skew", func(*http.Request) error {
+			return clockskew.Default.Check()
+		}),
+	}
+}
+
+// ListenAndServeAdmin serves the probes and metrics of the agent on addr until ctx is done: /livez, /readyz, /healthz
+// kept for older manifests, and /metrics. ?verbose lists the result of each check. /healthz is the liveness probe of
+// older manifests, so it only checks the admin server is up.
+func ListenAndServeAdmin(ctx context.Context, addr string, logger *logrus.Logger, status *AgentStatus) error {
+	mux := http.NewServeMux()
+	healthz.InstallPathHandler(mux, "/livez", status.LivezChecks()...)
+	healthz.InstallPathHandler(mux, "/readyz", status.ReadyzChecks()...)
+	healthz.InstallPathHandler(mux, "/healthz", healthz.PingHealthz)
+	mux.Handle("/metrics", metrics.Handler())
+	s := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+	logger.Infof("start admin server and listen on addr: %s", addr)
+	if err := s.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
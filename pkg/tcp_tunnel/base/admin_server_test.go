@@ -0,0 +1,40 @@
+package base
+
+import (
+	"testing"
+	"time"
+)
+
+func checkAgentLoop(s *AgentStatus) error {
+	for _, check := range s.LivezChecks() {
+		if check.Name() == "agent-loop" {
+			return check.Check(nil)
+		}
+	}
+	panic("no agent-loop check")
+}
+
+func TestLivezAgentLoop(t *testing.T) {
+	s := NewAgentStatus()
+	if err := checkAgentLoop(s); err != nil {
+		t.Fatalf("idle agent loop: %v", err)
+	}
+
+	done := s.Busy()
+	if err := checkAgentLoop(s); err != nil {
+		t.Fatalf("agent loop handling a request: %v", err)
+	}
+	stuck := s.Busy()
+	s.busy[s.nextBusy-1] = time.Now().Add(-s.LivenessTimeout - time.Second)
+	if err := checkAgentLoop(s); err == nil {
+		t.Fatal("agent loop stuck on a request passed")
+	}
+	stuck()
+	if err := checkAgentLoop(s); err != nil {
+		t.Fatalf("agent loop after the stuck request was handed over: %v", err)
+	}
+	done()
+	if len(s.busy) != 0 {
+		t.Fatalf("%d requests still recorded as in the agent loop", len(s.busy))
+	}
+}
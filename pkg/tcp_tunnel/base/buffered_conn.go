@@ -0,0 +1,34 @@
+package base
+
+import (
+	"bufio"
+	"errors"
+	"net"
+
+	"github.com/hashicorp/yamux"
+)
+
+var ErrHalfCloseNotSupported = errors.New("connection does not support half-close")
+
+// BufferedConn is a net.Conn whose reads go through a bufio.Reader that may already hold data read from the conn,
+// e.g. after http.ReadRequest or http.ReadResponse.
+type BufferedConn struct {
+	*bufio.Reader
+	net.Conn
+}
+
+func (c *BufferedConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, so the peer reads EOF while this side keeps
+// reading. Closing a yamux stream only sends FIN, the stream stays readable until the peer closes it as well.
+func (c *BufferedConn) CloseWrite() error {
+	switch conn := c.Conn.(type) {
+	case interface{ CloseWrite() error }:
+		return conn.CloseWrite()
+	case *yamux.Stream:
+		return conn.Close()
+	}
+	return ErrHalfCloseNotSupported
+}
@@ -0,0 +1,157 @@
+package base
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultMaxFrameSize is the largest SPDY or websocket payload accepted by frame inspection.
+const DefaultMaxFrameSize = 16 << 20
+
+// FrameTooLargeError is returned when a frame announces a payload larger than the maximum frame size. The session
+// is terminated since the stream cannot be resynchronized.
+type FrameTooLargeError struct {
+	Protocol string
+	Size     uint64
+	Max      int
+}
+
+func (e FrameTooLargeError) Error() string {
+	return fmt.Sprintf("%s frame of %d bytes exceeds maximum frame size %d", e.Protocol, e.Size, e.Max)
+}
+
+var (
+	readerPool = sync.Pool{New: func() interface{} { return bufio.NewReaderSize(nil, BufferSize) }}
+	bufferPool = sync.Pool{New: func() interface{} { b := make([]byte, BufferSize); return &b }}
+)
+
+// frameCopyFunc copies exactly one frame from r to w. It returns io.EOF only when r ends at a frame boundary.
+type frameCopyFunc func(w io.Writer, r *bufio.Reader, buf []byte) (int64, error)
+
+// copyFrames copies from r to w frame by frame until EOF is reached at a frame boundary. Frames are never held in
+// memory as a whole, the payload is streamed through a pooled buffer.
+func copyFrames(ctx context.Context, w io.Writer, r io.Reader, copyFrame frameCopyFunc, log *logrus.Entry) (int64, error) {
+	reader := readerPool.Get().(*bufio.Reader)
+	reader.Reset(r)
+	buf := bufferPool.Get().(*[]byte)
+	defer func() {
+		reader.Reset(nil)
+		readerPool.Put(reader)
+		bufferPool.Put(buf)
+	}()
+
+	var written int64
+	for {
+		select {
+		case <-ctx.Done():
+			return written, ctx.Err()
+		default:
+			n, err := copyFrame(w, reader, *buf)
+			written += n
+			if err == io.EOF {
+				return written, nil
+			}
+			if err != nil {
+				return written, err
+			}
+			log.Tracef("Frame of %d bytes transferred.", n)
+		}
+	}
+}
+
+// copyHeader reads a frame header of len(header) bytes. EOF before the first byte is reported as io.EOF, EOF in the
+// middle of the header as io.ErrUnexpectedEOF.
+func copyHeader(w io.Writer, r *bufio.Reader, header []byte) error {
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+// copyPayload streams length bytes from r to w.
+func copyPayload(w io.Writer, r *bufio.Reader, length int64, buf []byte) (int64, error) {
+	n, err := io.CopyBuffer(w, io.LimitReader(r, length), buf)
+	if err == nil && n < length {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// copySPDYFrame copies a SPDY frame, which consists of an 8-byte header with the 24-bit payload length in its last
+// three bytes.
+// Reference: https://www.chromium.org/spdy/spdy-protocol/spdy-protocol-draft3-1 section 2.2.
+func (endpoint *TunnelEndpoint) copySPDYFrame(w io.Writer, r *bufio.Reader, buf []byte) (int64, error) {
+	var header [8]byte
+	if err := copyHeader(w, r, header[:]); err != nil {
+		return 0, err
+	}
+	length := uint64(header[5])<<16 | uint64(header[6])<<8 | uint64(header[7])
+	if length > uint64(endpoint.maxFrameSize()) {
+		return int64(len(header)), FrameTooLargeError{Protocol: "SPDY", Size: length, Max: endpoint.maxFrameSize()}
+	}
+	n, err := copyPayload(w, r, int64(length), buf)
+	return int64(len(header)) + n, err
+}
+
+// copyWebsocketFrame copies a websocket frame: 2 bytes of header, an optional 2 or 8 bytes extended payload length,
+// an optional 4 bytes masking key and the payload.
+// Reference: https://www.rfc-editor.org/rfc/rfc6455#section-5.2.
+func (endpoint *TunnelEndpoint) copyWebsocketFrame(w io.Writer, r *bufio.Reader, buf []byte) (int64, error) {
+	var header [14]byte
+	if err := copyHeader(w, r, header[:2]); err != nil {
+		return 0, err
+	}
+	headerLen := 2
+	masked := header[1]&0x80 == 0x80
+	length := uint64(header[1] & 0x7F)
+
+	extra := 0
+	switch length {
+	case 126:
+		extra = 2
+	case 127:
+		extra = 8
+	}
+	if masked {
+		extra += 4
+	}
+	if extra > 0 {
+		if err := copyHeader(w, r, header[2:2+extra]); err != nil {
+			return int64(headerLen), unexpectedEOF(err)
+		}
+		switch length {
+		case 126:
+			length = uint64(binary.BigEndian.Uint16(header[2:4]))
+		case 127:
+			length = binary.BigEndian.Uint64(header[2:10])
+		}
+		headerLen += extra
+	}
+	if length > uint64(endpoint.maxFrameSize()) {
+		return int64(headerLen), FrameTooLargeError{Protocol: "websocket", Size: length, Max: endpoint.maxFrameSize()}
+	}
+	n, err := copyPayload(w, r, int64(length), buf)
+	return int64(headerLen) + n, err
+}
+
+func (endpoint *TunnelEndpoint) maxFrameSize() int {
+	if endpoint.MaxFrameSize <= 0 {
+		return DefaultMaxFrameSize
+	}
+	return endpoint.MaxFrameSize
+}
+
+// unexpectedEOF converts io.EOF in the middle of a frame to io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
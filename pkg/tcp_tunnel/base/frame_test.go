@@ -0,0 +1,173 @@
+package base
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testMaxFrameSize = 1024
+
+func spdyFrame(length int) []byte {
+	frame := []byte{0x80, 0x03, 0x00, 0x07, 0x00, byte(length >> 16), byte(length >> 8), byte(length)}
+	return append(frame, bytes.Repeat([]byte{'s'}, length)...)
+}
+
+func websocketFrame(length int, masked bool) []byte {
+	frame := []byte{0x82, 0}
+	switch {
+	case length < 126:
+		frame[1] = byte(length)
+	case length <= 0xFFFF:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	if masked {
+		frame[1] |= 0x80
+		frame = append(frame, 1, 2, 3, 4)
+	}
+	return append(frame, bytes.Repeat([]byte{'w'}, length)...)
+}
+
+func concat(frames ...[]byte) []byte {
+	return bytes.Join(frames, nil)
+}
+
+// copyAll copies input frame by frame like a pipe with frame inspection does.
+func copyAll(input []byte, copyFrame frameCopyFunc) ([]byte, int64, error) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	n, err := copyFrames(context.Background(), &out, bytes.NewReader(input), copyFrame, logrus.NewEntry(logger))
+	return out.Bytes(), n, err
+}
+
+func TestCopyFrames(t *testing.T) {
+	endpoint := &TunnelEndpoint{MaxFrameSize: testMaxFrameSize}
+	tests := []struct {
+		name      string
+		copyFrame frameCopyFunc
+		input     []byte
+		// written is the prefix of input expected to be copied, all of it if -1. Incomplete headers are not copied.
+		written int
+		err     error
+	}{
+		{"spdy/eof at boundary", endpoint.copySPDYFrame, concat(spdyFrame(0), spdyFrame(10), spdyFrame(testMaxFrameSize)), -1, nil},
+		{"spdy/empty", endpoint.copySPDYFrame, nil, -1, nil},
+		{"spdy/eof in header", endpoint.copySPDYFrame, concat(spdyFrame(10), spdyFrame(10)[:5]), 18, io.ErrUnexpectedEOF},
+		{"spdy/eof in payload", endpoint.copySPDYFrame, spdyFrame(10)[:12], -1, io.ErrUnexpectedEOF},
+		{"spdy/too large", endpoint.copySPDYFrame, concat(spdyFrame(10), spdyFrame(testMaxFrameSize+1)), 26, FrameTooLargeError{Protocol: "SPDY", Size: testMaxFrameSize + 1, Max: testMaxFrameSize}},
+
+		{"websocket/eof at boundary", endpoint.copyWebsocketFrame, concat(websocketFrame(0, false), websocketFrame(125, true), websocketFrame(126, false), websocketFrame(testMaxFrameSize, true)), -1, nil},
+		{"websocket/empty", endpoint.copyWebsocketFrame, nil, -1, nil},
+		{"websocket/eof in header", endpoint.copyWebsocketFrame, websocketFrame(10, false)[:1], 0, io.ErrUnexpectedEOF},
+		{"websocket/eof in extended length", endpoint.copyWebsocketFrame, websocketFrame(200, false)[:3], 2, io.ErrUnexpectedEOF},
+		{"websocket/eof in masking key", endpoint.copyWebsocketFrame, websocketFrame(10, true)[:4], 2, io.ErrUnexpectedEOF},
+		{"websocket/eof in payload", endpoint.copyWebsocketFrame, websocketFrame(10, true)[:8], -1, io.ErrUnexpectedEOF},
+		{"websocket/too large", endpoint.copyWebsocketFrame, concat(websocketFrame(10, false), websocketFrame(testMaxFrameSize+1, true)), 20, FrameTooLargeError{Protocol: "websocket", Size: testMaxFrameSize + 1, Max: testMaxFrameSize}},
+		{"websocket/64-bit length", endpoint.copyWebsocketFrame, websocketFrame(0x10000, false)[:10], -1, FrameTooLargeError{Protocol: "websocket", Size: 0x10000, Max: testMaxFrameSize}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, n, err := copyAll(test.input, test.copyFrame)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			written := test.written
+			if written < 0 {
+				written = len(test.input)
+			}
+			if n != int64(written) || !bytes.Equal(out, test.input[:written]) {
+				t.Fatalf("got %d bytes copied, want the first %d bytes of the input", n, written)
+			}
+		})
+	}
+}
+
+// fuzzFrames checks that any input is copied unchanged up to the point the copy stops, and that it only stops
+// with the documented errors.
+func fuzzFrames(f *testing.F, copyFrame func(endpoint *TunnelEndpoint) frameCopyFunc, seeds ...[]byte) {
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	endpoint := &TunnelEndpoint{MaxFrameSize: testMaxFrameSize}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		out, n, err := copyAll(input, copyFrame(endpoint))
+		var tooLarge FrameTooLargeError
+		switch {
+		case err == nil:
+			if n != int64(len(input)) {
+				t.Fatalf("copy ended without error after %d of %d bytes", n, len(input))
+			}
+		case err == io.ErrUnexpectedEOF:
+		case errors.As(err, &tooLarge):
+			if tooLarge.Size <= testMaxFrameSize || tooLarge.Max != testMaxFrameSize {
+				t.Fatalf("unexpected %v", err)
+			}
+		default:
+			t.Fatalf("unexpected error %v", err)
+		}
+		if n != int64(len(out)) || !bytes.Equal(out, input[:n]) {
+			t.Fatalf("copied %d bytes which are not the first %d bytes of the input", len(out), n)
+		}
+	})
+}
+
+func FuzzReadSPDYFrame(f *testing.F) {
+	fuzzFrames(f, func(endpoint *TunnelEndpoint) frameCopyFunc { return endpoint.copySPDYFrame },
+		concat(spdyFrame(0), spdyFrame(16)),
+		spdyFrame(testMaxFrameSize + 1)[:8],
+		spdyFrame(3)[:9],
+	)
+}
+
+func FuzzReadWebsocketFrame(f *testing.F) {
+	fuzzFrames(f, func(endpoint *TunnelEndpoint) frameCopyFunc { return endpoint.copyWebsocketFrame },
+		concat(websocketFrame(0, false), websocketFrame(16, true)),
+		websocketFrame(300, true),
+		websocketFrame(0x10000, false)[:10],
+		websocketFrame(10, true)[:5],
+	)
+}
+
+func TestFrameTooLargeEndsSession(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	endpoint := NewTunnelEndpoint(context.Background(), logger)
+	endpoint.FrameInspection = true
+	endpoint.MaxFrameSize = testMaxFrameSize
+
+	client, endpointA := net.Pipe()
+	endpointB, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Upgrade", "websocket")
+	response := &http.Response{StatusCode: http.StatusSwitchingProtocols, Header: http.Header{"Upgrade": {"websocket"}}}
+	done := make(chan struct{})
+	go func() {
+		endpoint.CheckAndStartPipe(request, response, endpointA, endpointB)
+		close(done)
+	}()
+	// the rest of the frame is never read, so the write does not return
+	go client.Write(websocketFrame(testMaxFrameSize+1, true))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not terminated by a frame exceeding the maximum frame size")
+	}
+}
@@ -2,10 +2,10 @@ package base
 
 import (
 	"context"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/metrics"
 	"github.com/alibaba/alibabacloud-ack-connector/pkg/vars"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"net"
-	"net/http"
 	"sync/atomic"
 	"time"
 
@@ -49,6 +49,7 @@ func (h *Heart) Beat() {
 			}
 			n, e := h.conn.Write(beat)
 			if e != nil {
+				metrics.HeartbeatFailures.Inc()
 				h.logger.Error("heartbeat to stub server failed:", e)
 				return
 			}
@@ -70,9 +71,9 @@ func (h *Heart) CheckCluster() {
 	_, err = client.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{LabelSelector: vars.AlibabacloudNodeLabel})
 	if err != nil {
 		h.logger.Errorf("health check failed with err %v", err)
-		atomic.StoreInt32(&h.status, 1)
+		h.setStatus(err)
 	} else {
-		atomic.StoreInt32(&h.status, 0)
+		h.setStatus(nil)
 	}
 	t := time.NewTicker(15 * CheckInterval)
 	var cnt = 0
@@ -85,11 +86,11 @@ func (h *Heart) CheckCluster() {
 		case <-t.C:
 			_, err := client.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{LabelSelector: "alibabacloud.com/external=true"})
 			if err != nil {
-				atomic.StoreInt32(&h.status, 1)
+				h.setStatus(err)
 				h.logger.Errorf("heart beat to cluster err %v", err)
 				continue
 			}
-			atomic.StoreInt32(&h.status, 0)
+			h.setStatus(nil)
 			if cnt == 0 {
 				h.logger.Trace("check K8s cluster success..")
 			}
@@ -98,6 +99,16 @@ func (h *Heart) CheckCluster() {
 	}
 }
 
+// setStatus records the result of the cluster check, it is reported to the stub by heartbeats and by /readyz.
+func (h *Heart) setStatus(err error) {
+	var status int32
+	if err != nil {
+		status = 1
+	}
+	atomic.StoreInt32(&h.status, status)
+	DefaultStatus.SetClusterHealth(err)
+}
+
 // Heartbeat send heartbeat byte to stub requester each HeartbeatInterval in order to maintain connection.
 // Otherwise, requester will decrease the health of this connection and in the end kick it off.
 func Heartbeat(ctx context.Context, logger *logrus.Logger, conn net.Conn, cfg *rest.Config) {
@@ -111,16 +122,3 @@ func Heartbeat(ctx context.Context, logger *logrus.Logger, conn net.Conn, cfg *r
 	go h.CheckCluster()
 	h.Beat()
 }
-
-func StartHealthzServer(addr string, logger *logrus.Logger) {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, req *http.Request) {
-		rw.WriteHeader(http.StatusOK)
-	})
-	s := &http.Server{
-		Addr:    addr,
-		Handler: mux,
-	}
-	logger.Infof("start healthz server and listen on addr: %s", addr)
-	s.ListenAndServe()
-}
@@ -0,0 +1,32 @@
+package base
+
+// SessionPool runs sessions of a tunnel in their own goroutines and bounds the number of sessions in flight.
+type SessionPool struct {
+	slots chan struct{}
+}
+
+func NewSessionPool(size int) *SessionPool {
+	if size <= 0 {
+		size = DefaultMaxSessionsPerTunnel
+	}
+	return &SessionPool{slots: make(chan struct{}, size)}
+}
+
+// TrySubmit runs session in a new goroutine if the pool is not full. It returns false without blocking otherwise.
+func (p *SessionPool) TrySubmit(session func()) bool {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		return false
+	}
+	go func() {
+		defer func() { <-p.slots }()
+		session()
+	}()
+	return true
+}
+
+// InFlight returns the number of running sessions.
+func (p *SessionPool) InFlight() int {
+	return len(p.slots)
+}
@@ -2,20 +2,30 @@ package base
 
 import (
 	"context"
-	"encoding/binary"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/metrics"
 	"github.com/sirupsen/logrus"
 	"io"
 	"net/http"
+	"strings"
 )
 
 // TunnelEndpoint is initially designed for common parts of stub and agent.
 type TunnelEndpoint struct {
 	Component
+	// FrameInspection reads SPDY and websocket traffic frame by frame instead of copying raw bytes.
+	FrameInspection bool
+	// MaxFrameSize is the largest frame payload accepted by frame inspection, DefaultMaxFrameSize if not set.
+	MaxFrameSize int
 }
 
 const (
 	SessionIDHeaderKey = "X-Tunnel-Session-ID"
 	BufferSize         = 4096
+	// SessionCancelMethod is the method of the request written to a tunnel by the stub to cancel the session with
+	// the same session ID, when the client goes away before the session connection is established.
+	SessionCancelMethod = "CANCEL"
+
+	DefaultMaxSessionsPerTunnel = 100
 )
 
 func NewTunnelEndpoint(ctx context.Context, logger *logrus.Logger) TunnelEndpoint {
@@ -24,175 +34,97 @@ func NewTunnelEndpoint(ctx context.Context, logger *logrus.Logger) TunnelEndpoin
 	}
 }
 
-// CheckAndStartPipe will check request header and response status code to see if there is a successful upgrade negotiation.
+// CheckAndStartPipe will check response status code to see if there is a successful upgrade negotiation, and pipes
+// the upgraded connections whatever protocol was negotiated.
 // The order of endpointA and endpointB only affect to log, A2B is forward and B2A is backward. X2Y means read from X and write to Y.
-// This pipe is a full duplex pipe. The close of this pipe is caused by either context done or any error from any connection.
-// The data is read in SPDY format where the auxiliary function `readSPDYFrame` does.
-// Reference: https://www.chromium.org/spdy/spdy-protocol/spdy-protocol-draft3-1 section 2.2.
-func (endpoint *TunnelEndpoint) CheckAndStartPipe(request *http.Request, response *http.Response, endpointA io.ReadWriter, endpointB io.ReadWriter) {
-	if request.Header.Get("Upgrade") == "SPDY/3.1" && response.StatusCode == 101 {
-		logger := endpoint.Logger.WithField(SessionIDHeaderKey, request.Header.Get(SessionIDHeaderKey))
-		logger.Tracef("Upgrade to protocol %s, SPDY pipe start", request.Header.Get("Upgrade"))
-		ctx, cancel := context.WithCancel(endpoint.Context)
-		pipe := func(r io.Reader, w io.Writer, log *logrus.Entry) {
-			log.Tracef("Start pipe")
-			defer cancel()
-			for {
-				select {
-				case <-ctx.Done():
-					log.Tracef("Exit")
-					return
-				default:
-					log.Tracef("Reading")
-					bytes, err := endpoint.readSPDYFrame(r, log)
-					if err != nil {
-						log.Tracef("Read failed: ", err)
-						return
-					}
-					log.Tracef("Read completed")
-					n, err := w.Write(bytes)
-					if err != nil {
-						log.Tracef("Write failed: ", err)
-						return
-					}
-					log.Tracef("Write completed, %d bytes transferred.", n)
-				}
-			}
-		}
-		go pipe(endpointA, endpointB, logger.WithField("pipe", "forward"))
-		go pipe(endpointB, endpointA, logger.WithField("pipe", "backward"))
-		<-ctx.Done()
+// This pipe is a full duplex pipe. When one direction reaches EOF, the write side of its destination is closed if
+// the destination supports half-close, and the other direction keeps running. The close of this pipe is caused by
+// either context done, including the context of the request, any error from any connection, or both directions
+// finished.
+// With FrameInspection enabled, SPDY and websocket traffic is copied frame by frame where the auxiliary functions
+// `copySPDYFrame` and `copyWebsocketFrame` do, and frames larger than MaxFrameSize terminate the session.
+// The bytes piped in each direction are returned.
+func (endpoint *TunnelEndpoint) CheckAndStartPipe(request *http.Request, response *http.Response, endpointA io.ReadWriter, endpointB io.ReadWriter) (forwardBytes, backwardBytes int64) {
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return 0, 0
 	}
-
-	if request.Header.Get("Upgrade") == "websocket" && response.StatusCode == 101 {
-		logger := endpoint.Logger.WithField(SessionIDHeaderKey, request.Header.Get(SessionIDHeaderKey))
-		logger.Tracef("Upgrade to protocol %s, websocket pipe start", request.Header.Get("Upgrade"))
-		ctx, cancel := context.WithCancel(endpoint.Context)
-		pipe := func(r io.Reader, w io.Writer, log *logrus.Entry) {
-			defer cancel()
-			for {
-				select {
-				case <-ctx.Done():
-					log.Debugf("Exit")
-					return
-				default:
-					log.Tracef("Reading")
-					bytes, err := endpoint.readWebsocketFrame(r, log)
-					if err != nil {
-						log.Tracef("Read failed: ", err)
-						return
-					}
-					log.Tracef("Read completed")
-					n, err := w.Write(bytes)
-					if err != nil {
-						log.Tracef("Write failed: ", err)
-						return
-					}
-					log.Tracef("Write completed, %d bytes transferred.", n)
-				}
-			}
-		}
-		go pipe(endpointA, endpointB, logger.WithField("pipe", "forward"))
-		go pipe(endpointB, endpointA, logger.WithField("pipe", "backward"))
-		<-ctx.Done()
+	protocol := response.Header.Get("Upgrade")
+	if protocol == "" {
+		protocol = request.Header.Get("Upgrade")
 	}
-}
+	logger := endpoint.Logger.WithField(SessionIDHeaderKey, request.Header.Get(SessionIDHeaderKey))
+	logger.Tracef("Upgrade to protocol %s, pipe start", protocol)
+	activeSessions := metrics.SessionsActive.WithLabelValues(metrics.UpgradeType(protocol))
+	activeSessions.Inc()
+	defer activeSessions.Dec()
 
-func (endpoint *TunnelEndpoint) readSPDYFrame(reader io.Reader, log *logrus.Entry) ([]byte, error) {
-	log.Debugf("[ReadFrame] start read SPDY Frame")
-	header := make([]byte, 8)
-	cnt := 0
-	log.Debugf("[ReadFrame] reading header")
-	for cnt < 8 {
-		n, err := reader.Read(header[cnt:])
-		if err != nil {
-			return nil, err
-		}
-		log.Debugf("[ReadFrame] reading head %d bytes", n)
-		cnt += n
-	}
-	log.Debugf("[ReadFrame] header read complete")
-	length := int(binary.BigEndian.Uint32(append([]byte{0}, header[5:8]...))) + 8
-	frame := make([]byte, length)
-	copy(frame, header)
-	log.Debugf("[ReadFrame] reading body [%d bytes]", length-8)
-	for cnt < length {
-		n, err := reader.Read(frame[cnt:])
-		if err != nil {
-			return nil, err
+	var copyFrame frameCopyFunc
+	if endpoint.FrameInspection {
+		switch strings.ToLower(protocol) {
+		case "spdy/3.1":
+			copyFrame = endpoint.copySPDYFrame
+		case "websocket":
+			copyFrame = endpoint.copyWebsocketFrame
 		}
-		cnt += n
 	}
-	log.Debugf("[ReadFrame] body read complete")
-	return frame, nil
-}
-
-func readFrame(size int, reader io.Reader, log *logrus.Entry) ([]byte, error) {
-	data := make([]byte, 0)
-	for {
-		if len(data) == size {
-			break
-		}
-		// Temporary slice to read chunk
-		sz := BufferSize
-		remaining := size - len(data)
-		if sz > remaining {
-			sz = remaining
-		}
-		temp := make([]byte, sz)
 
-		n, err := reader.Read(temp)
-		if err != nil && err != io.EOF {
-			return data, err
+	ctx, cancel := context.WithCancel(endpoint.Context)
+	defer cancel()
+	done := make(chan struct{}, 2)
+	forward := &metrics.CountingWriter{Writer: endpointB, Counter: metrics.PipedBytes.WithLabelValues("forward")}
+	backward := &metrics.CountingWriter{Writer: endpointA, Counter: metrics.PipedBytes.WithLabelValues("backward")}
+	// the pipes may still be running when a canceled session returns, so the counts are read atomically
+	defer func() {
+		forwardBytes, backwardBytes = forward.Written(), backward.Written()
+	}()
+	pipe := func(r io.Reader, counted *metrics.CountingWriter, direction string) {
+		defer func() { done <- struct{}{} }()
+		log := logger.WithField("pipe", direction)
+		log.Tracef("Start pipe")
+		w := counted.Writer
+		var n int64
+		var err error
+		if copyFrame != nil {
+			n, err = copyFrames(ctx, counted, r, copyFrame, log)
+		} else {
+			n, err = io.Copy(counted, r)
 		}
-		data = append(data, temp[:n]...)
-	}
-	return data, nil
-}
-
-func (endpoint *TunnelEndpoint) readWebsocketFrame(reader io.Reader, log *logrus.Entry) ([]byte, error) {
-	log.Tracef("[ReadFrame] start")
-	head, err := readFrame(2, reader, log)
-	if err != nil {
-		return nil, err
-	}
-
-	result := make([]byte, 0)
-	result = append(result, head[:2]...)
-	IsMasked := (head[1] & 0x80) == 0x80
-
-	var length uint64
-	length = uint64(head[1] & 0x7F)
-
-	if length == 126 {
-		lenBytes, err := readFrame(2, reader, log)
 		if err != nil {
-			return nil, err
+			if _, ok := err.(FrameTooLargeError); ok {
+				log.Warnf("Session terminated: %s", err)
+			} else {
+				log.Tracef("Pipe failed after %d bytes transferred: %s", n, err)
+			}
+			cancel()
+			return
 		}
-		length = uint64(binary.BigEndian.Uint16(lenBytes))
-		result = append(result, lenBytes[:2]...)
-	} else if length == 127 {
-		lenBytes, err := readFrame(8, reader, log)
-		if err != nil {
-			return nil, err
+		log.Tracef("Read completed, %d bytes transferred.", n)
+		if !closeWrite(w) {
+			// the peer cannot be told about EOF without closing the whole session
+			cancel()
 		}
-		length = binary.BigEndian.Uint64(lenBytes)
-		result = append(result, lenBytes[:8]...)
 	}
-	if IsMasked {
-		maskKey, err := readFrame(4, reader, log)
-		if err != nil {
-			return nil, err
+	go pipe(endpointA, forward, "forward")
+	go pipe(endpointB, backward, "backward")
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ctx.Done():
+			logger.Tracef("Exit")
+			return
+		case <-request.Context().Done():
+			logger.Tracef("Session canceled")
+			return
+		case <-done:
 		}
-		result = append(result, maskKey[:4]...)
 	}
+	logger.Tracef("Both directions finished")
+	return
+}
 
-	payload, err := readFrame(int(length), reader, log) // possible data loss
-	if err != nil {
-		log.Errorf("[ReadFrame] payload err: %v", err)
-		return nil, err
+// closeWrite half-closes w if it supports it, e.g. *net.TCPConn, *tls.Conn and *WebsocketConn.
+func closeWrite(w io.Writer) bool {
+	if closer, ok := w.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite() == nil
 	}
-	result = append(result, payload[:length]...)
-	log.Tracef("[ReadFrame] payload append")
-	return result, err
+	return false
 }
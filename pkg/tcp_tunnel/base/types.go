@@ -2,6 +2,46 @@ package base
 
 type TunnelState string
 
+const (
+	TunnelStateConnected    TunnelState = "connected"
+	TunnelStateDisconnected TunnelState = "disconnected"
+)
+
+// Connection types sent as the first byte of the handshake, see StubConnector.Connect.
+const (
+	ConnTypeTunnel  byte = 0
+	ConnTypeSession byte = 1
+	ConnTypeMeta    byte = 2
+	// ConnTypeMuxTunnel registers a tunnel carrying all sessions as yamux streams. The stub answers MuxAccepted
+	// after the cluster id if it supports it, and MuxRefused or closes the connection if it does not.
+	ConnTypeMuxTunnel byte = 3
+)
+
+// Answers of the stub to ConnTypeMuxTunnel. They start with a NUL byte, which no HTTP request written by a stub
+// mistaking the connection for a plain tunnel starts with.
+const (
+	MuxAccepted = "\x00mux-accepted"
+	MuxRefused  = "\x00mux-refused\x00"
+)
+
+// Transports carrying the connections to the stub.
+const (
+	// TransportTLS dials the stub with TLS.
+	TransportTLS = "tls"
+	// TransportWebsocket carries the connections as binary messages of a wss:// websocket, for sites which only allow
+	// HTTPS on 443.
+	TransportWebsocket = "websocket"
+	// TransportAuto starts with TLS and switches between the transports when dialing fails repeatedly.
+	TransportAuto = "auto"
+
+	// WebsocketPath is the path the stub serves websocket connections on.
+	WebsocketPath = "/tunnel"
+)
+
+// DefaultMaxRequestBodySize is the largest request body read off a tunnel, the limit the api server applies to
+// request bodies by default.
+const DefaultMaxRequestBodySize = 3 << 20
+
 const (
 	DefaultAgentNamespace    string = "kube-system"
 	ConfigMapProviderName    string = "provider"
@@ -11,6 +51,13 @@ const (
 	ConfigMapScriptPathKey   string = "addNodeScriptPath"
 )
 
+// Keys and values of AgentMeta.Data.
+const (
+	// AgentMetaStateKey is only sent once the agent is shutting down, with AgentStateDraining.
+	AgentMetaStateKey  string = "state"
+	AgentStateDraining string = "draining"
+)
+
 // Note: Any change to this struct needs to update DeepCopy function as well.
 type AgentMeta struct {
 	Provider         string            `json:"provider"`
@@ -0,0 +1,60 @@
+package base
+
+import (
+	"io"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebsocketConn carries a byte stream as binary messages of a websocket. An empty text message marks the end of the
+// stream written by the peer, so the websocket can be half-closed like a TCP connection. Peers predating it ignore
+// the empty message, since empty messages are never seen by websocket.Conn.Read.
+type WebsocketConn struct {
+	*websocket.Conn
+	// buf holds the rest of the last message read
+	buf []byte
+	eof bool
+}
+
+func NewWebsocketConn(ws *websocket.Conn) *WebsocketConn {
+	ws.PayloadType = websocket.BinaryFrame
+	return &WebsocketConn{Conn: ws}
+}
+
+// websocketMessage is a message received by websocketCodec, eof is set by the end of stream marker.
+type websocketMessage struct {
+	data []byte
+	eof  bool
+}
+
+var websocketCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		return nil, websocket.TextFrame, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		msg := v.(*websocketMessage)
+		msg.data, msg.eof = data, payloadType == websocket.TextFrame && len(data) == 0
+		return nil
+	},
+}
+
+func (c *WebsocketConn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		var msg websocketMessage
+		if err := websocketCodec.Receive(c.Conn, &msg); err != nil {
+			return 0, err
+		}
+		c.buf, c.eof = msg.data, msg.eof
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// CloseWrite sends the end of stream marker, the peer reads EOF while this side keeps reading.
+func (c *WebsocketConn) CloseWrite() error {
+	return websocketCodec.Send(c.Conn, nil)
+}
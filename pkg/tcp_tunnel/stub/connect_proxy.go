@@ -0,0 +1,72 @@
+package stub
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ListenAndServeProxy runs a minimal HTTP CONNECT proxy on addr, standing in for a corporate egress proxy when the
+// proxy support of the agent is tested locally. If auth is not empty, clients must authenticate with it as
+// "user:password" using basic authentication.
+func (s *Server) ListenAndServeProxy(addr, auth string) error {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: s.ProxyHandler(auth),
+	}
+	go func() {
+		<-s.Done()
+		server.Close()
+	}()
+	s.Logger.Infof("connect proxy listen on %s", addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// ProxyHandler returns the handler of the proxy run by ListenAndServeProxy.
+func (s *Server) ProxyHandler(auth string) http.HandlerFunc {
+	var credentials string
+	if auth != "" {
+		credentials = "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
+	}
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			http.Error(rw, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if credentials != "" && req.Header.Get("Proxy-Authorization") != credentials {
+			rw.Header().Set("Proxy-Authenticate", `Basic realm="ack-stub"`)
+			http.Error(rw, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		target, err := net.DialTimeout("tcp", req.Host, HandshakeTimeout)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		clientConn, buf, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			s.Logger.Errorf("hijack proxy connection failed: %s", err)
+			return
+		}
+		defer clientConn.Close()
+		if _, err = clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			return
+		}
+		s.Logger.Tracef("proxy %s to %s", clientConn.RemoteAddr(), req.Host)
+		done := make(chan struct{}, 2)
+		go func() {
+			io.Copy(target, buf)
+			done <- struct{}{}
+		}()
+		go func() {
+			io.Copy(clientConn, target)
+			done <- struct{}{}
+		}()
+		<-done
+	}
+}
@@ -0,0 +1,213 @@
+package stub
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
+	"github.com/sirupsen/logrus"
+)
+
+// MetaPath serves the StubMeta of the server on the kube listener.
+const MetaPath = "/stub/meta"
+
+// ListenAndServeKube runs a plain HTTP listener on addr which behaves like a kube-apiserver, so kubectl can be
+// pointed at it with `--server http://<addr>`. Every request is forwarded to the agent through the tunnel.
+func (s *Server) ListenAndServeKube(addr string) error {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: s.Handler(),
+	}
+	go func() {
+		<-s.Done()
+		server.Close()
+	}()
+	s.Logger.Infof("kube server listen on %s", addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(MetaPath, s.serveStubMeta)
+	mux.HandleFunc("/", s.proxy)
+	return mux
+}
+
+func (s *Server) serveStubMeta(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(s.Meta())
+}
+
+func (s *Server) proxy(rw http.ResponseWriter, req *http.Request) {
+	request, sessionConn, err := s.dispatch(req)
+	if err != nil {
+		s.Logger.Errorf("dispatch %s %s failed: %s", req.Method, req.URL, err)
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer sessionConn.Close()
+	logger := s.Logger.WithField(base.SessionIDHeaderKey, request.Header.Get(base.SessionIDHeaderKey))
+	stopWatch := closeOnCancel(req.Context(), sessionConn, logger)
+	defer stopWatch()
+
+	reader := bufio.NewReader(sessionConn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		logger.Errorf("read response failed: %s", err)
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+	logger.Tracef("%s %s: %d", req.Method, req.URL, response.StatusCode)
+
+	if response.StatusCode == http.StatusSwitchingProtocols {
+		// the context of a hijacked request is canceled as soon as the client half-closes, the pipe watches the
+		// connections instead
+		stopWatch()
+		request = request.WithContext(s.Context)
+		hijacker, ok := rw.(http.Hijacker)
+		if !ok {
+			http.Error(rw, "upgrade is not supported", http.StatusInternalServerError)
+			return
+		}
+		clientConn, buf, err := hijacker.Hijack()
+		if err != nil {
+			logger.Errorf("hijack connection failed: %s", err)
+			return
+		}
+		defer clientConn.Close()
+		if err = response.Write(clientConn); err != nil {
+			logger.Errorf("write upgrade response failed: %s", err)
+			return
+		}
+		s.CheckAndStartPipe(request, response, &base.BufferedConn{Reader: buf.Reader, Conn: clientConn}, &base.BufferedConn{Reader: reader, Conn: sessionConn})
+		return
+	}
+
+	for key, values := range response.Header {
+		for _, value := range values {
+			rw.Header().Add(key, value)
+		}
+	}
+	rw.WriteHeader(response.StatusCode)
+	copyAndFlush(rw, response.Body)
+}
+
+// closeOnCancel closes the session connection when ctx is done, which tells the agent to cancel the session. The
+// returned function stops watching ctx.
+func closeOnCancel(ctx context.Context, sessionConn net.Conn, logger *logrus.Entry) func() {
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			logger.Trace("client gone, close session connection")
+			sessionConn.Close()
+		case <-finished:
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(finished) }) }
+}
+
+// dispatch writes the request to a registered tunnel and waits for the agent to open the session connection of it.
+func (s *Server) dispatch(req *http.Request) (*http.Request, net.Conn, error) {
+	t, err := s.pickTunnel()
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.session != nil {
+		return s.dispatchStream(req, t)
+	}
+	sessionID, ch, err := s.newPendingSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	request := req.Clone(req.Context())
+	request.Header.Set(base.SessionIDHeaderKey, strconv.Itoa(int(sessionID)))
+
+	t.dispatch.Lock()
+	t.conn.SetWriteDeadline(time.Now().Add(s.sessionTimeout))
+	err = request.Write(t.conn)
+	t.dispatch.Unlock()
+	if err != nil {
+		s.cancelPendingSession(sessionID, ch)
+		return nil, nil, fmt.Errorf("write request to tunnel: %s", err)
+	}
+
+	timer := time.NewTimer(s.sessionTimeout)
+	defer timer.Stop()
+	select {
+	case conn := <-ch:
+		return request, conn, nil
+	case <-timer.C:
+		s.cancelPendingSession(sessionID, ch)
+		s.cancelSession(t, sessionID)
+		return nil, nil, fmt.Errorf("session %d timeout", sessionID)
+	case <-req.Context().Done():
+		s.cancelPendingSession(sessionID, ch)
+		s.cancelSession(t, sessionID)
+		return nil, nil, req.Context().Err()
+	}
+}
+
+// cancelSession asks the agent to abort a session whose connection has not been established yet.
+func (s *Server) cancelSession(t *tunnel, sessionID uint16) {
+	request, err := http.NewRequest(base.SessionCancelMethod, "/", nil)
+	if err != nil {
+		return
+	}
+	request.Header.Set(base.SessionIDHeaderKey, strconv.Itoa(int(sessionID)))
+	t.dispatch.Lock()
+	defer t.dispatch.Unlock()
+	t.conn.SetWriteDeadline(time.Now().Add(s.sessionTimeout))
+	if err = request.Write(t.conn); err != nil {
+		s.Logger.WithField(base.SessionIDHeaderKey, sessionID).Debugf("write cancel request to tunnel failed: %s", err)
+	}
+}
+
+// dispatchStream opens a new stream on a multiplexed tunnel for the request, the agent answers on the same stream.
+func (s *Server) dispatchStream(req *http.Request, t *tunnel) (*http.Request, net.Conn, error) {
+	stream, err := t.session.OpenStream()
+	if err != nil {
+		return nil, nil, fmt.Errorf("open stream: %s", err)
+	}
+	request := req.Clone(req.Context())
+	request.Header.Set(base.SessionIDHeaderKey, strconv.Itoa(int(s.nextSessionID())))
+	if err = request.Write(stream); err != nil {
+		stream.Close()
+		return nil, nil, fmt.Errorf("write request to stream: %s", err)
+	}
+	return request, stream, nil
+}
+
+// copyAndFlush copies the response body to the client and flushes after each read, so streaming responses such as
+// watch and logs -f are delivered immediately.
+func copyAndFlush(rw http.ResponseWriter, body io.Reader) {
+	flusher, _ := rw.(http.Flusher)
+	buf := make([]byte, base.BufferSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := rw.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
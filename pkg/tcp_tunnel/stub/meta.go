@@ -0,0 +1,59 @@
+package stub
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/id"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
+	"github.com/sirupsen/logrus"
+)
+
+// MetaTimeout is how long the stub waits for the next meta message. The agent syncs meta every 3 seconds.
+const MetaTimeout = 30 * time.Second
+
+// serveMeta reads AgentMeta messages written by agent.MetaMessenger and acknowledges each of them with "ack".
+// Only every 20th message carries the full meta, the others are empty and only keep the connection alive.
+func (s *Server) serveMeta(conn net.Conn, clusterID id.ID, logger *logrus.Entry) {
+	defer conn.Close()
+	logger.Info("meta connection established")
+	decoder := json.NewDecoder(conn)
+	for {
+		var agentMeta base.AgentMeta
+		conn.SetReadDeadline(time.Now().Add(MetaTimeout))
+		if err := decoder.Decode(&agentMeta); err != nil {
+			logger.Infof("meta connection closed: %s", err)
+			return
+		}
+		if agentMeta.K8sVersion != "" || agentMeta.Provider != "" {
+			logger.Tracef("agent meta updated: %+v", agentMeta)
+			s.lock.Lock()
+			s.agentsMeta[clusterID.String()] = agentMeta
+			s.lock.Unlock()
+		}
+		if state, ok := agentMeta.Data[base.AgentMetaStateKey]; ok {
+			s.setAgentState(clusterID, state, logger)
+		}
+		conn.SetWriteDeadline(time.Now().Add(3 * time.Second))
+		if _, err := conn.Write([]byte("ack")); err != nil {
+			logger.Infof("write meta ack failed: %s", err)
+			return
+		}
+	}
+}
+
+// setAgentState records the state reported by the agent, e.g. base.AgentStateDraining during its shutdown.
+func (s *Server) setAgentState(clusterID id.ID, state string, logger *logrus.Entry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	agentMeta := s.agentsMeta[clusterID.String()]
+	if agentMeta.Data[base.AgentMetaStateKey] == state {
+		return
+	}
+	logger.Infof("agent state changed to %s", state)
+	var meta base.AgentMeta
+	agentMeta.DeepCopy(&meta)
+	meta.Data[base.AgentMetaStateKey] = state
+	s.agentsMeta[clusterID.String()] = meta
+}
@@ -0,0 +1,266 @@
+package stub
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/common"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/id"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
+	"github.com/hashicorp/yamux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	HandshakeTimeout = 10 * time.Second
+	SessionTimeout   = 60 * time.Second
+)
+
+var ErrNoTunnel = errors.New("no tunnel registered")
+
+// Server is a reference implementation of the stub side of the tunnel protocol. It accepts tunnel, meta and session
+// connections from agents and dispatches HTTP requests received on its kube listener to the registered tunnels.
+// It is meant for local end-to-end testing and only serves a single cluster at a time.
+type Server struct {
+	base.TunnelEndpoint
+	// Multiplex accepts tunnels which carry all sessions as yamux streams, see StubConnector.ConnectMux.
+	Multiplex bool
+
+	tlsConfig      *tls.Config
+	sessionTimeout time.Duration
+
+	lock          sync.Mutex
+	tunnels       []*tunnel
+	next          int
+	sessionID     uint16
+	pending       map[uint16]chan net.Conn
+	agentsMeta    map[string]base.AgentMeta
+	activeCluster string
+}
+
+func NewServer(ctx context.Context, logger *logrus.Logger, tlsConfig *tls.Config) *Server {
+	return &Server{
+		TunnelEndpoint: base.NewTunnelEndpoint(ctx, logger),
+		Multiplex:      true,
+		tlsConfig:      tlsConfig,
+		sessionTimeout: SessionTimeout,
+		pending:        make(map[uint16]chan net.Conn),
+		agentsMeta:     make(map[string]base.AgentMeta),
+	}
+}
+
+// ListenAndServe accepts agent connections on addr until the context is done.
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := tls.Listen("tcp", addr, s.tlsConfig)
+	if err != nil {
+		return err
+	}
+	s.Logger.Infof("stub server listen on %s", addr)
+	return s.Serve(listener)
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	go func() {
+		<-s.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Meta returns the current state of the stub and the meta reported by connected agents.
+func (s *Server) Meta() base.StubMeta {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	meta := base.StubMeta{
+		State:         base.TunnelStateDisconnected,
+		ActiveCluster: s.activeCluster,
+		AgentsMeta:    make(map[string]base.AgentMeta, len(s.agentsMeta)),
+		Version:       common.GetVersion().Version,
+	}
+	for _, t := range s.tunnels {
+		if t.healthy() {
+			meta.State = base.TunnelStateConnected
+			break
+		}
+	}
+	for cluster, agentMeta := range s.agentsMeta {
+		var dest base.AgentMeta
+		agentMeta.DeepCopy(&dest)
+		meta.AgentsMeta[cluster] = dest
+	}
+	return meta
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	logger := s.Logger.WithField("remote", conn.RemoteAddr().String())
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		logger.Debugf("read handshake failed: %s", err)
+		conn.Close()
+		return
+	}
+	connType := header[0]
+	sessionID := binary.BigEndian.Uint16(header[1:3])
+	if connType == base.ConnTypeSession {
+		conn.SetReadDeadline(time.Time{})
+		s.attachSession(sessionID, conn, logger)
+		return
+	}
+
+	var clusterID id.ID
+	if _, err := io.ReadFull(conn, clusterID[:]); err != nil {
+		logger.Debugf("read cluster id failed: %s", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	logger = logger.WithField("cluster", clusterID.String())
+
+	switch connType {
+	case base.ConnTypeTunnel:
+		s.serveTunnel(newTunnel(conn, clusterID), logger)
+	case base.ConnTypeMuxTunnel:
+		s.serveMuxTunnel(conn, clusterID, logger)
+	case base.ConnTypeMeta:
+		s.serveMeta(conn, clusterID, logger)
+	default:
+		logger.Warnf("unknown connection type %d", connType)
+		conn.Close()
+	}
+}
+
+func (s *Server) attachSession(sessionID uint16, conn net.Conn, logger *logrus.Entry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ch, ok := s.pending[sessionID]
+	if !ok {
+		logger.Warnf("no pending session %d, drop connection", sessionID)
+		conn.Close()
+		return
+	}
+	delete(s.pending, sessionID)
+	// the channel is buffered and only ever receives one connection
+	ch <- conn
+}
+
+func (s *Server) serveTunnel(t *tunnel, logger *logrus.Entry) {
+	s.lock.Lock()
+	s.tunnels = append(s.tunnels, t)
+	s.activeCluster = t.clusterID.String()
+	s.lock.Unlock()
+	logger.Info("tunnel registered")
+
+	err := t.readHeartbeats()
+	logger.Infof("tunnel unregistered: %v", err)
+
+	s.lock.Lock()
+	for i, v := range s.tunnels {
+		if v == t {
+			s.tunnels = append(s.tunnels[:i], s.tunnels[i+1:]...)
+			break
+		}
+	}
+	s.lock.Unlock()
+	t.close()
+}
+
+func (s *Server) serveMuxTunnel(conn net.Conn, clusterID id.ID, logger *logrus.Entry) {
+	if !s.Multiplex {
+		logger.Info("multiplexed tunnel refused")
+		conn.Write([]byte(base.MuxRefused))
+		conn.Close()
+		return
+	}
+	if _, err := conn.Write([]byte(base.MuxAccepted)); err != nil {
+		logger.Debugf("accept multiplexed tunnel failed: %s", err)
+		conn.Close()
+		return
+	}
+	config := yamux.DefaultConfig()
+	config.LogOutput = ioutil.Discard
+	session, err := yamux.Server(conn, config)
+	if err != nil {
+		logger.Errorf("create multiplexed session failed: %s", err)
+		conn.Close()
+		return
+	}
+	// the first stream opened by the agent carries heartbeats
+	heartbeat, err := session.Accept()
+	if err != nil {
+		logger.Errorf("accept heartbeat stream failed: %s", err)
+		session.Close()
+		return
+	}
+	s.serveTunnel(newMuxTunnel(session, heartbeat, clusterID), logger)
+}
+
+// pickTunnel returns the next registered tunnel in round robin order.
+func (s *Server) pickTunnel() (*tunnel, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.tunnels) == 0 {
+		return nil, ErrNoTunnel
+	}
+	s.next = (s.next + 1) % len(s.tunnels)
+	return s.tunnels[s.next], nil
+}
+
+// nextSessionID returns the next session id for a multiplexed tunnel. Streams need no pending session, the id is
+// only used to correlate logs.
+func (s *Server) nextSessionID() uint16 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessionID++
+	if s.sessionID == 0 {
+		s.sessionID++
+	}
+	return s.sessionID
+}
+
+// newPendingSession allocates an unused session id and the channel its session connection will be delivered to.
+func (s *Server) newPendingSession() (uint16, chan net.Conn, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := 0; i < 1<<16; i++ {
+		s.sessionID++
+		if s.sessionID == 0 {
+			continue
+		}
+		if _, ok := s.pending[s.sessionID]; !ok {
+			ch := make(chan net.Conn, 1)
+			s.pending[s.sessionID] = ch
+			return s.sessionID, ch, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("too many pending sessions")
+}
+
+func (s *Server) cancelPendingSession(sessionID uint16, ch chan net.Conn) {
+	s.lock.Lock()
+	delete(s.pending, sessionID)
+	s.lock.Unlock()
+	// the session connection may have raced with the cancellation
+	select {
+	case conn := <-ch:
+		conn.Close()
+	default:
+	}
+}
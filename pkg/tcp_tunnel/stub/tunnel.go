@@ -0,0 +1,69 @@
+package stub
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/id"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/vars"
+	"github.com/hashicorp/yamux"
+)
+
+// HeartbeatTimeout is how long a tunnel may stay silent before it is considered dead. The agent beats every
+// 15 * base.HeartbeatInterval.
+const HeartbeatTimeout = 45 * base.HeartbeatInterval
+
+// tunnel is a registration connection of an agent. The stub writes HTTP requests to it and reads heartbeat frames
+// from it. For multiplexed tunnels conn is the heartbeat stream opened by the agent and every request gets its own
+// stream of session.
+type tunnel struct {
+	conn      net.Conn
+	session   *yamux.Session
+	clusterID id.ID
+	// dispatch serializes requests written to the tunnel.
+	dispatch sync.Mutex
+	// status is the last cluster status reported by heartbeat, 0 represents ok.
+	status int32
+}
+
+func newTunnel(conn net.Conn, clusterID id.ID) *tunnel {
+	return &tunnel{
+		conn:      conn,
+		clusterID: clusterID,
+	}
+}
+
+func newMuxTunnel(session *yamux.Session, heartbeat net.Conn, clusterID id.ID) *tunnel {
+	return &tunnel{
+		conn:      heartbeat,
+		session:   session,
+		clusterID: clusterID,
+	}
+}
+
+func (t *tunnel) close() {
+	t.conn.Close()
+	if t.session != nil {
+		t.session.Close()
+	}
+}
+
+// readHeartbeats blocks until the tunnel is broken or stays silent for longer than HeartbeatTimeout.
+func (t *tunnel) readHeartbeats() error {
+	beat := make([]byte, vars.PayloadLength)
+	for {
+		t.conn.SetReadDeadline(time.Now().Add(HeartbeatTimeout))
+		if _, err := io.ReadFull(t.conn, beat); err != nil {
+			return err
+		}
+		atomic.StoreInt32(&t.status, int32(beat[0]))
+	}
+}
+
+func (t *tunnel) healthy() bool {
+	return atomic.LoadInt32(&t.status) == 0
+}
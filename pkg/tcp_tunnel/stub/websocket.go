@@ -0,0 +1,58 @@
+package stub
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
+	"golang.org/x/net/websocket"
+)
+
+// ListenAndServeWebsocket accepts agent connections carried by websockets on base.WebsocketPath, which is how agents
+// using the websocket transport reach the stub. TLS is terminated with the certificate of the stub.
+func (s *Server) ListenAndServeWebsocket(addr string) error {
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   s.WebsocketHandler(),
+		TLSConfig: s.tlsConfig,
+		// websockets need HTTP/1.1
+		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
+	}
+	go func() {
+		<-s.Done()
+		server.Close()
+	}()
+	s.Logger.Infof("websocket server listen on %s", addr)
+	if err := server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// WebsocketHandler serves the websockets of agents on base.WebsocketPath.
+func (s *Server) WebsocketHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(base.WebsocketPath, websocket.Handler(s.serveWebsocket))
+	return mux
+}
+
+// serveWebsocket handles the websocket like a connection accepted by Serve. The websocket is closed when this handler
+// returns, so it waits until the connection is closed by its user.
+func (s *Server) serveWebsocket(ws *websocket.Conn) {
+	conn := &closeNotifyConn{WebsocketConn: base.NewWebsocketConn(ws), closed: make(chan struct{})}
+	s.handleConn(conn)
+	<-conn.closed
+}
+
+// closeNotifyConn closes the closed channel when the connection is closed.
+type closeNotifyConn struct {
+	*base.WebsocketConn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *closeNotifyConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.WebsocketConn.Close()
+}
@@ -0,0 +1,145 @@
+package tcp_tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/metrics"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/agent"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/rest"
+)
+
+// StableTunnelPeriod is how long a tunnel has to serve before its reconnection backoff is reset.
+const StableTunnelPeriod = time.Minute
+
+// superviseTunnel owns one of the TunnelsPerAgent tunnels. It registers the tunnel, serves requests on it until it
+// fails and registers it again with backoff, while the other tunnels keep serving. It returns when the context of
+// the client is done.
+func (client *AgentClient) superviseTunnel(index int, cfg *rest.Config) {
+	logger := client.Logger.WithField("tunnel", index)
+	backoffConfig := client.newTunnelBackoff()
+	for {
+		start := time.Now()
+		err := client.runTunnel(cfg, logger)
+		if client.Err() != nil {
+			logger.Trace("tunnel supervisor finished by context done")
+			return
+		}
+		if time.Since(start) > client.stableTunnelPeriod {
+			backoffConfig.Reset()
+		}
+		metrics.TunnelReconnects.Inc()
+		wait := backoffConfig.NextBackOff()
+		logger.Warnf("tunnel failed: %v, reconnect after %s", err, wait)
+		select {
+		case <-client.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// newTunnelBackoff is the reconnection backoff of a tunnel supervisor.
+func newTunnelBackoff() backoff.BackOff {
+	backoffConfig := backoff.NewExponentialBackOff()
+	backoffConfig.InitialInterval = agent.NonSessionBackoffInitialInterval
+	backoffConfig.Multiplier = agent.NonSessionBackoffMultiplier
+	backoffConfig.RandomizationFactor = agent.NonSessionBackoffRandomizationFactor
+	backoffConfig.MaxInterval = agent.NonSessionBackoffMaxInterval
+	backoffConfig.MaxElapsedTime = agent.NonSessionBackoffMaxElapsedTime
+	backoffConfig.Reset()
+	return backoffConfig
+}
+
+// runTunnel registers a tunnel and serves requests on it until it fails.
+func (client *AgentClient) runTunnel(cfg *rest.Config, logger *logrus.Entry) error {
+	ctx, cancel := context.WithCancel(client.Context)
+	defer cancel()
+	if atomic.LoadInt32(&client.multiplex) == 1 {
+		session, err := client.stubConnector.ConnectMux()
+		if err == nil {
+			logger.Info("tunnel registered")
+			defer base.DefaultStatus.TunnelUp()()
+			return client.serveMux(ctx, session, cfg)
+		}
+		if err != agent.ErrMuxNotSupported {
+			return err
+		}
+		if atomic.CompareAndSwapInt32(&client.multiplex, 1, 0) {
+			logger.Info("stub does not support multiplexed tunnels, fall back to connection per session")
+		}
+	}
+
+	conn, err := client.stubConnector.Connect(base.ConnTypeTunnel, 0)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	logger.Info("tunnel registered")
+	defer base.DefaultStatus.TunnelUp()()
+	go base.Heartbeat(ctx, client.Logger, conn, cfg)
+	return client.serveTunnel(ctx, conn)
+}
+
+// serveTunnel reads requests from a tunnel connection until the connection is broken, e.g. closed by heartbeat
+// failure, or the context is done.
+func (client *AgentClient) serveTunnel(ctx context.Context, conn net.Conn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	pool := base.NewSessionPool(client.maxSessionsPerTunnel)
+	reader := bufio.NewReader(conn)
+	for {
+		request, done, err := client.nextRequest(reader)
+		var tooLarge *requestTooLargeError
+		if err != nil && !errors.As(err, &tooLarge) {
+			done()
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		client.handleRequest(pool, request, tooLarge)
+		done()
+	}
+}
+
+// nextRequest waits for the next request on reader and reads it. The agent loop counts as busy from the first byte of
+// the request until the returned function is called once the request is handed over, so a request which is never
+// completed or handed over fails /livez while waiting for a request does not.
+func (client *AgentClient) nextRequest(reader *bufio.Reader) (*http.Request, func(), error) {
+	if _, err := reader.Peek(1); err != nil {
+		return nil, func() {}, err
+	}
+	done := base.DefaultStatus.Busy()
+	request, err := readRequest(reader, client.maxRequestBodySize)
+	return request, done, err
+}
+
+// handleRequest hands a request read off the tunnel over to its session, tooLarge is set if readRequest discarded
+// its body.
+func (client *AgentClient) handleRequest(pool *base.SessionPool, request *http.Request, tooLarge *requestTooLargeError) {
+	sessionID, parseErr := parseSessionID(request)
+	if parseErr != nil {
+		client.Logger.Error("read tunnel session id failed: ", parseErr)
+		return
+	}
+	if tooLarge != nil {
+		client.rejectTooLarge(sessionID, request, nil, tooLarge.size)
+		return
+	}
+	if request.Method == base.SessionCancelMethod {
+		client.cancelSession(pool, sessionID)
+		return
+	}
+	client.dispatch(pool, sessionID, request, nil)
+}
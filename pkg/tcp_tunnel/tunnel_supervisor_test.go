@@ -0,0 +1,213 @@
+package tcp_tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/agent"
+	"github.com/alibaba/alibabacloud-ack-connector/pkg/tcp_tunnel/base"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/hashicorp/yamux"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestClient(ctx context.Context) *AgentClient {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	return &AgentClient{
+		TunnelEndpoint:       base.NewTunnelEndpoint(ctx, logger),
+		maxSessionsPerTunnel: 1,
+		maxRequestBodySize:   1024,
+		sessions:             map[sessionKey]*session{},
+		draining:             make(chan struct{}),
+		newTunnelBackoff:     newTunnelBackoff,
+		stableTunnelPeriod:   StableTunnelPeriod,
+	}
+}
+
+func checkLivez(status *base.AgentStatus) error {
+	for _, check := range status.LivezChecks() {
+		if err := check.Check(nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestServeTunnelLivez(t *testing.T) {
+	status := base.DefaultStatus
+	defer func(timeout time.Duration) { status.LivenessTimeout = timeout }(status.LivenessTimeout)
+	status.LivenessTimeout = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	agentConn, stubConn := net.Pipe()
+	served := make(chan error, 1)
+	go func() { served <- newTestClient(ctx).serveTunnel(ctx, agentConn) }()
+
+	time.Sleep(2 * status.LivenessTimeout)
+	if err := checkLivez(status); err != nil {
+		t.Fatalf("agent loop waiting for a request: %v", err)
+	}
+
+	// the body is never completed, so the loop is stuck reading the request
+	io.WriteString(stubConn, "POST /echo HTTP/1.1\r\nHost: test\r\nContent-Length: 10\r\n\r\nabc")
+	time.Sleep(2 * status.LivenessTimeout)
+	if err := checkLivez(status); err == nil {
+		t.Fatal("agent loop stuck on a request passed")
+	}
+
+	stubConn.Close()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("serveTunnel did not return when the tunnel was closed")
+	}
+	if err := checkLivez(status); err != nil {
+		t.Fatalf("agent loop after the tunnel was closed: %v", err)
+	}
+}
+
+// Sessions of different tunnels may have the same ID, a CANCEL on one tunnel must not cancel the session of the
+// other, and a session reusing an ID is not forgotten when the previous one finishes.
+func TestCancelSessionOfTunnel(t *testing.T) {
+	client := newTestClient(context.Background())
+	tunnelA, tunnelB := base.NewSessionPool(1), base.NewSessionPool(1)
+	ctxA, doneA, _ := client.newSessionContext(tunnelA, 7)
+	ctxB, doneB, _ := client.newSessionContext(tunnelB, 7)
+	defer doneB()
+
+	client.cancelSession(tunnelA, 7)
+	if ctxA.Err() == nil {
+		t.Fatal("session of tunnel A not canceled")
+	}
+	if ctxB.Err() != nil {
+		t.Fatal("session of tunnel B canceled by a CANCEL on tunnel A")
+	}
+
+	ctxReused, doneReused, _ := client.newSessionContext(tunnelA, 7)
+	defer doneReused()
+	doneA()
+	client.cancelSession(tunnelA, 7)
+	if ctxReused.Err() == nil {
+		t.Fatal("session reusing the ID was forgotten when the previous session finished")
+	}
+}
+
+// failingConnector fails every tunnel registration, the registrations listed in hold fail after the given time as if
+// the tunnel served until then.
+type failingConnector struct {
+	lock  sync.Mutex
+	calls []time.Time
+	hold  map[int]time.Duration
+}
+
+func (c *failingConnector) Connect(byte, uint16) (net.Conn, error) {
+	c.lock.Lock()
+	c.calls = append(c.calls, time.Now())
+	hold := c.hold[len(c.calls)]
+	c.lock.Unlock()
+	time.Sleep(hold)
+	return nil, errors.New("stub unavailable")
+}
+
+func (c *failingConnector) ConnectContext(context.Context, byte, uint16) (net.Conn, error) {
+	return c.Connect(0, 0)
+}
+
+func (c *failingConnector) ConnectMux() (*yamux.Session, error) {
+	return nil, agent.ErrMuxNotSupported
+}
+
+func (c *failingConnector) callTimes() []time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]time.Time(nil), c.calls...)
+}
+
+// recordingBackOff records the waits of a backoff.
+type recordingBackOff struct {
+	backoff.BackOff
+	lock  sync.Mutex
+	waits []time.Duration
+}
+
+func (b *recordingBackOff) NextBackOff() time.Duration {
+	wait := b.BackOff.NextBackOff()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.waits = append(b.waits, wait)
+	return wait
+}
+
+// The delays between registrations of a failing tunnel grow, are reset after a tunnel served for the stable period,
+// and the supervisor returns when the context of the client is done.
+func TestSuperviseTunnel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newTestClient(ctx)
+	// the fifth registration serves longer than the stable period
+	conn := &failingConnector{hold: map[int]time.Duration{5: 100 * time.Millisecond}}
+	client.stubConnector = conn
+	client.stableTunnelPeriod = 50 * time.Millisecond
+	waits := &recordingBackOff{}
+	client.newTunnelBackoff = func() backoff.BackOff {
+		b := backoff.NewExponentialBackOff()
+		b.InitialInterval = 10 * time.Millisecond
+		b.Multiplier = 2
+		b.RandomizationFactor = 0
+		b.MaxElapsedTime = 0
+		b.Reset()
+		waits.BackOff = b
+		return waits
+	}
+
+	supervised := make(chan struct{})
+	go func() {
+		client.superviseTunnel(0, nil)
+		close(supervised)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(conn.callTimes()) < 7 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d registrations, want 7", len(conn.callTimes()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-supervised:
+	case <-time.After(time.Second):
+		t.Fatal("superviseTunnel did not return when the context was done")
+	}
+	calls := conn.callTimes()
+	time.Sleep(100 * time.Millisecond)
+	if n := len(conn.callTimes()); n != len(calls) {
+		t.Fatalf("%d registrations after the context was done", n-len(calls))
+	}
+
+	waits.lock.Lock()
+	defer waits.lock.Unlock()
+	want := []time.Duration{10, 20, 40, 80, 10, 20}
+	for i, w := range want {
+		if waits.waits[i] != w*time.Millisecond {
+			t.Fatalf("got waits %v, want them to start with %v ms", waits.waits, want)
+		}
+	}
+	// the registration after each wait is not dialed before the wait is over
+	for i := 1; i < len(calls); i++ {
+		gap := calls[i].Sub(calls[i-1])
+		if i == 5 {
+			gap -= 100 * time.Millisecond
+		}
+		if gap < waits.waits[i-1] {
+			t.Errorf("registration %d after %s, want at least %s", i+1, gap, waits.waits[i-1])
+		}
+	}
+}
@@ -1,8 +1,14 @@
 package utils
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func RedirectRequest(req *http.Request, targetURL *url.URL) {
@@ -24,3 +30,34 @@ func RedirectRequest(req *http.Request, targetURL *url.URL) {
 	req.Host = req.URL.Host
 	req.RequestURI = ""
 }
+
+// NewStatusResponse builds a response carrying a Kubernetes Status object, the way api server reports failures.
+func NewStatusResponse(req *http.Request, code int, reason metav1.StatusReason, message string) *http.Response {
+	status := metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Reason:   reason,
+		Code:     int32(code),
+	}
+	body, _ := json.Marshal(&status)
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// NoProxy is a rest.Config Proxy which dials the api server directly. Proxy variables in the environment of the
+// agent are meant for reaching the stub only.
+func NoProxy(*http.Request) (*url.URL, error) {
+	return nil, nil
+}
@@ -12,6 +12,8 @@ const (
 	ConnectToken            = "token"
 	ConvertUrl              = "url"
 	SECRET_NAME             = "SECRET_NAME"
+	SECRET_SELECTOR         = "CREDENTIALS_SECRET_SELECTOR"
+	CAChecksum              = "ACK_CA_CHECKSUM"
 	PayloadLength           = 8
 	AlibabacloudNodeLabel   = "alibabacloud.com/external=true"
 